@@ -0,0 +1,56 @@
+package httpclient
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tokenSource interface {
+	Token() (string, error)
+}
+
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// fileToken rereads the token file when its size or modification time
+// changes, so rotated credentials are picked up without a restart.
+type fileToken struct {
+	path string
+
+	mu      sync.Mutex
+	size    int64
+	modTime time.Time
+	token   string
+}
+
+func (t *fileToken) Token() (string, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat bearer token file: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.token) != 0 && info.Size() == t.size && info.ModTime().Equal(t.modTime) {
+		return t.token, nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if len(token) == 0 {
+		return "", fmt.Errorf("bearer token file %s is empty", t.path)
+	}
+	t.token = token
+	t.size = info.Size()
+	t.modTime = info.ModTime()
+	return t.token, nil
+}
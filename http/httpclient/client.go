@@ -3,6 +3,7 @@ package httpclient
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
@@ -24,9 +25,11 @@ var DefaultTransport = &http.Transport{
 }
 
 type Client struct {
-	client *http.Client
-	user   string
-	pwd    string
+	client  *http.Client
+	user    string
+	pwd     string
+	headers map[string]string
+	token   tokenSource
 }
 
 func New(transport *http.Transport) *Client {
@@ -49,23 +52,85 @@ func (s *Client) WithBasicAuth(user, pwd string) {
 	s.pwd = pwd
 }
 
+// WithHeaders sets headers sent with every request. Headers passed to a
+// single request take precedence.
+func (s *Client) WithHeaders(headers map[string]string) {
+	s.headers = make(map[string]string, len(headers))
+	for key, value := range headers {
+		s.headers[key] = value
+	}
+}
+
+// WithBearerToken sends "Authorization: Bearer <token>" with every
+// request, replacing basic auth.
+func (s *Client) WithBearerToken(token string) {
+	s.token = staticToken(token)
+}
+
+// WithBearerTokenFile is like WithBearerToken but reads the token from
+// path, reloading it whenever the file changes. Read errors are returned
+// by the request.
+func (s *Client) WithBearerTokenFile(path string) {
+	s.token = &fileToken{path: path}
+}
+
+// WithTLSConfig sets the TLS configuration on a copy of the transport, so
+// DefaultTransport is never modified.
+func (s *Client) WithTLSConfig(cfg *tls.Config) {
+	transport, ok := s.client.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = DefaultTransport
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = cfg
+	s.client.Transport = transport
+}
+
 func (s *Client) Request(method, url string, header map[string]string, body []byte) (rsp *http.Response, respBody []byte, err error) {
 	return s.RequestWithContext(context.Background(), method, url, header, body)
 }
 
 func (s *Client) RequestWithContext(ctx context.Context, method, url string, header map[string]string, body []byte) (rsp *http.Response, respBody []byte, err error) {
-	var req *http.Request
+	rsp, err = s.StreamWithContext(ctx, method, url, header, body)
+	if err != nil {
+		return
+	}
+
+	defer rsp.Body.Close()
+
+	respBody, err = io.ReadAll(rsp.Body)
+
+	return
+}
+
+// StreamWithContext sends the request and returns the response without
+// reading its body. The caller must close rsp.Body.
+func (s *Client) StreamWithContext(ctx context.Context, method, url string, header map[string]string, body []byte) (rsp *http.Response, err error) {
 	if body != nil {
-		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
-	} else {
-		req, err = http.NewRequestWithContext(ctx, method, url, nil)
+		return s.DoWithContext(ctx, method, url, header, bytes.NewReader(body))
 	}
+	return s.DoWithContext(ctx, method, url, header, nil)
+}
 
+// DoWithContext is like StreamWithContext but reads the request body from
+// an io.Reader, so large payloads can be streamed.
+func (s *Client) DoWithContext(ctx context.Context, method, url string, header map[string]string, body io.Reader) (rsp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return
 	}
 
-	if len(s.user) != 0 && len(s.pwd) != 0 {
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+
+	if s.token != nil {
+		token, err := s.token.Token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if len(s.user) != 0 && len(s.pwd) != 0 {
 		req.SetBasicAuth(s.user, s.pwd)
 	}
 
@@ -77,14 +142,5 @@ func (s *Client) RequestWithContext(ctx context.Context, method, url string, hea
 		req.Host = value
 	}
 
-	rsp, err = s.client.Do(req)
-	if err != nil {
-		return
-	}
-
-	defer rsp.Body.Close()
-
-	respBody, err = io.ReadAll(rsp.Body)
-
-	return
+	return s.client.Do(req)
 }
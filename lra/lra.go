@@ -37,19 +37,41 @@ type Cache struct {
 	cache     map[string]*list.Element
 	lock      sync.RWMutex
 	OnEvicted func(key string, value Value)
+
+	idleTimeout time.Duration
+	stop        chan struct{}
+	stopOnce    sync.Once
 }
 
+// New returns a cache that drops entries not accessed for a minute.
 func New(maxBytes int64, onEvicted func(string, Value)) *Cache {
+	return NewWithTimeout(maxBytes, time.Minute, onEvicted)
+}
+
+// NewWithTimeout returns a cache that drops entries not accessed for
+// idleTimeout. Call Stop to release the background eviction goroutine.
+func NewWithTimeout(maxBytes int64, idleTimeout time.Duration, onEvicted func(string, Value)) *Cache {
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
 	c := &Cache{
-		maxBytes:  maxBytes,
-		ll:        list.New(),
-		cache:     make(map[string]*list.Element),
-		OnEvicted: onEvicted,
+		maxBytes:    maxBytes,
+		ll:          list.New(),
+		cache:       make(map[string]*list.Element),
+		OnEvicted:   onEvicted,
+		idleTimeout: idleTimeout,
+		stop:        make(chan struct{}),
 	}
 	go c.startEvictionTimer()
 	return c
 }
 
+// Stop stops the background eviction goroutine. The cache stays usable but
+// idle entries are no longer dropped.
+func (c *Cache) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
 func (c *Cache) Get(key string) (value Value, ok bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -71,7 +93,7 @@ func (c *Cache) RemoveStaleEntries() {
 			return
 		}
 		entry := element.Value.(*entry)
-		if time.Since(entry.lastAccessTIme) > time.Minute {
+		if time.Since(entry.lastAccessTIme) > c.idleTimeout {
 			c.removeElement(element)
 			continue
 		}
@@ -117,11 +139,18 @@ func (c *Cache) removeElement(e *list.Element) {
 }
 
 func (c *Cache) startEvictionTimer() {
-	ticker := time.NewTicker(time.Minute)
+	ticker := time.NewTicker(min(c.idleTimeout, time.Minute))
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
 		c.RemoveStaleEntries()
+		c.lock.RLock()
 		lraUsedBytes.WithLabelValues().Set(float64(c.curBytes))
+		c.lock.RUnlock()
 		lraTotalBytes.WithLabelValues().Set(float64(c.maxBytes))
 	}
 }
@@ -0,0 +1,144 @@
+package promutil
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowLabelValue replaces every label value of the series that exceed
+// the limit of a CardinalityGuard created with WithOverflow.
+const OverflowLabelValue = "__overflow__"
+
+var cardinalityErrors *prometheus.CounterVec
+
+func init() {
+	cardinalityErrors, _ = NewErrorCounterVec("promutil_cardinality_guard", "Series evicted or folded into the overflow series by a cardinality guard.", []string{"metric"})
+}
+
+type labelVec[T any] interface {
+	prometheus.Collector
+	WithLabelValues(lvs ...string) T
+	DeleteLabelValues(lvs ...string) bool
+	Reset()
+}
+
+type GuardOption func(*guardOptions)
+
+type guardOptions struct {
+	overflow bool
+}
+
+// WithOverflow makes the guard fold new series into a single series whose
+// label values are all OverflowLabelValue once the limit is reached,
+// instead of evicting the least recently updated one.
+func WithOverflow() GuardOption {
+	return func(o *guardOptions) {
+		o.overflow = true
+	}
+}
+
+// CardinalityGuard wraps a CounterVec, GaugeVec or HistogramVec and keeps
+// at most limit series in it. Recency is tracked by WithLabelValues, so
+// callers must not hold on to the returned metric. Every eviction or
+// folded series increments promutil_cardinality_guard_errors_total.
+type CardinalityGuard[T any] struct {
+	vec   labelVec[T]
+	name  string
+	limit int
+	opts  guardOptions
+
+	mu     sync.Mutex
+	lru    *list.List
+	series map[string]*list.Element
+}
+
+// NewCardinalityGuard returns a guard for vec. name labels the error
+// counter and is usually the metric name of vec.
+func NewCardinalityGuard[T any](vec labelVec[T], name string, limit int, opts ...GuardOption) *CardinalityGuard[T] {
+	g := &CardinalityGuard[T]{
+		vec:    vec,
+		name:   name,
+		limit:  limit,
+		lru:    list.New(),
+		series: make(map[string]*list.Element),
+	}
+	for _, fn := range opts {
+		fn(&g.opts)
+	}
+	return g
+}
+
+// WithLabelValues returns the series for lvs, evicting the least recently
+// updated series or returning the overflow series when a new one would
+// exceed the limit.
+func (g *CardinalityGuard[T]) WithLabelValues(lvs ...string) T {
+	key := strings.Join(lvs, "\xff")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if e, ok := g.series[key]; ok {
+		g.lru.MoveToFront(e)
+		return g.vec.WithLabelValues(lvs...)
+	}
+
+	if g.limit > 0 && g.lru.Len() >= g.limit {
+		cardinalityErrors.WithLabelValues(g.name).Inc()
+		if g.opts.overflow {
+			overflow := make([]string, len(lvs))
+			for i := range overflow {
+				overflow[i] = OverflowLabelValue
+			}
+			return g.vec.WithLabelValues(overflow...)
+		}
+		oldest := g.lru.Back()
+		old := oldest.Value.([]string)
+		g.lru.Remove(oldest)
+		delete(g.series, strings.Join(old, "\xff"))
+		g.vec.DeleteLabelValues(old...)
+	}
+
+	metric := g.vec.WithLabelValues(lvs...)
+	g.series[key] = g.lru.PushFront(append([]string(nil), lvs...))
+	return metric
+}
+
+// DeleteLabelValues removes the series for lvs.
+func (g *CardinalityGuard[T]) DeleteLabelValues(lvs ...string) bool {
+	key := strings.Join(lvs, "\xff")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, ok := g.series[key]; ok {
+		g.lru.Remove(e)
+		delete(g.series, key)
+	}
+	return g.vec.DeleteLabelValues(lvs...)
+}
+
+// Len returns the number of tracked series, not counting the overflow
+// series.
+func (g *CardinalityGuard[T]) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lru.Len()
+}
+
+func (g *CardinalityGuard[T]) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lru.Init()
+	g.series = make(map[string]*list.Element)
+	g.vec.Reset()
+}
+
+func (g *CardinalityGuard[T]) Describe(ch chan<- *prometheus.Desc) {
+	g.vec.Describe(ch)
+}
+
+func (g *CardinalityGuard[T]) Collect(ch chan<- prometheus.Metric) {
+	g.vec.Collect(ch)
+}
@@ -0,0 +1,50 @@
+package promutil
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "guarded_total", Help: "h"}, []string{"path"})
+	g := NewCardinalityGuard(vec, "guarded_total", 2)
+	dropped := testutil.ToFloat64(cardinalityErrors.WithLabelValues("guarded_total"))
+
+	g.WithLabelValues("/a").Inc()
+	g.WithLabelValues("/b").Inc()
+	g.WithLabelValues("/a").Inc()
+	g.WithLabelValues("/c").Inc()
+
+	assert.Equal(2, g.Len())
+	assert.Equal(2, testutil.CollectAndCount(g))
+	assert.Equal(2.0, testutil.ToFloat64(vec.WithLabelValues("/a")))
+	assert.False(vec.DeleteLabelValues("/b"), "least recently updated series is evicted")
+	assert.Equal(dropped+1, testutil.ToFloat64(cardinalityErrors.WithLabelValues("guarded_total")))
+
+	assert.True(g.DeleteLabelValues("/a"))
+	assert.Equal(1, g.Len())
+	g.Reset()
+	assert.Equal(0, g.Len())
+	assert.Equal(0, testutil.CollectAndCount(g))
+}
+
+func TestCardinalityGuardOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "guarded_seconds", Help: "h"}, []string{"path", "code"})
+	g := NewCardinalityGuard(vec, "guarded_seconds", 1, WithOverflow())
+
+	g.WithLabelValues("/a", "200").Observe(1)
+	g.WithLabelValues("/b", "200").Observe(1)
+	g.WithLabelValues("/c", "500").Observe(1)
+
+	assert.Equal(1, g.Len())
+	assert.Equal(2, testutil.CollectAndCount(g))
+	assert.True(vec.DeleteLabelValues(OverflowLabelValue, OverflowLabelValue))
+	assert.True(vec.DeleteLabelValues("/a", "200"))
+}
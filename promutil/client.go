@@ -2,17 +2,18 @@ package promutil
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rosenlo/toolkits/http/httpclient"
-
-	"github.com/golang/snappy"
+	"github.com/rosenlo/toolkits/log"
 )
 
 const (
@@ -29,17 +30,28 @@ type Option func(*Client)
 type Config struct {
 	Address       string
 	InsertAddress string
+	// Tenant switches to the VictoriaMetrics cluster URL layout, as
+	// "accountID" or "accountID:projectID". Reads go to
+	// <Address>/select/<tenant>/prometheus and writes to
+	// <InsertAddress>/insert/<tenant>/prometheus.
+	Tenant string
 }
 
 type Client struct {
 	client *httpclient.Client
 	cfg    Config
+
+	writeVersion  string
+	compression   string
+	v2Unsupported atomic.Bool
 }
 
 func NewClient(cfg Config, opts ...Option) *Client {
 	c := &Client{
-		client: httpclient.New(nil),
-		cfg:    cfg,
+		client:       httpclient.New(nil),
+		cfg:          cfg,
+		writeVersion: RemoteWriteVersion1,
+		compression:  CompressionSnappy,
 	}
 	for _, o := range opts {
 		o(c)
@@ -53,6 +65,40 @@ func WithBasicAuth(user, pwd string) Option {
 	}
 }
 
+// WithBearerToken authenticates every read and write request with a
+// static bearer token.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.client.WithBearerToken(token)
+	}
+}
+
+// WithBearerTokenFile authenticates with the token stored in path, which
+// is reloaded whenever the file changes.
+func WithBearerTokenFile(path string) Option {
+	return func(c *Client) {
+		c.client.WithBearerTokenFile(path)
+	}
+}
+
+// WithHeaders adds static headers, such as X-Scope-OrgID for Mimir or
+// Cortex, to every request.
+func WithHeaders(headers map[string]string) Option {
+	return func(c *Client) {
+		c.client.WithHeaders(headers)
+	}
+}
+
+// WithTLSConfig sets the TLS client configuration, see
+// httpclient.NewTLSConfig for loading CA bundles and client certificates.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.client.WithTLSConfig(cfg)
+	}
+}
+
+// WithHttpClient replaces the underlying client. Options configuring the
+// client, like WithBasicAuth, must come after it.
 func WithHttpClient(client *httpclient.Client) Option {
 	return func(c *Client) {
 		c.client = client
@@ -60,166 +106,207 @@ func WithHttpClient(client *httpclient.Client) Option {
 }
 
 func (c *Client) Export(metric string, start, end int64) ([]byte, error) {
+	return c.ExportWithContext(context.Background(), metric, start, end)
+}
+
+func (c *Client) ExportWithContext(ctx context.Context, metric string, start, end int64) ([]byte, error) {
 	v := url.Values{}
 	v.Add("match[]", metric)
 	v.Add("start", strconv.FormatInt(start, 10))
 	v.Add("end", strconv.FormatInt(end, 10))
 
-	_url := fmt.Sprintf("%s%s?%s", c.cfg.Address, V1Export, v.Encode())
-
-	headers := map[string]string{
-		"Content-Type": "application/x-www-form-urlencoded",
-	}
-	resp, respBody, err := c.client.Request("POST", _url, headers, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to request %s; err: %v", V1Export, err)
-	}
-	if resp != nil && resp.StatusCode > 399 {
-		log.Printf("---> request: %s", _url)
-		log.Printf("<--- response status: %s", resp.Status)
-		return nil, fmt.Errorf("failed to request %s resp: %s; err: %v", V1Export, string(respBody), err)
-	}
-	return respBody, nil
+	return c.request(ctx, "POST", V1Export, v)
 }
 
 func (c *Client) Query(metric string, start time.Time, step string) (*QueryResponse, error) {
-	var response QueryResponse
+	return c.QueryWithContext(context.Background(), metric, start, step)
+}
+
+func (c *Client) QueryWithContext(ctx context.Context, metric string, start time.Time, step string) (*QueryResponse, error) {
 	v := url.Values{}
 	v.Add("query", metric)
-	if start.Second() != 0 {
-		v.Add("time", start.Format(time.RFC3339))
+	if !start.IsZero() {
+		v.Add("time", formatTimestamp(start))
 	}
 	if len(step) != 0 {
 		v.Add("step", step)
 	}
 
-	_url := fmt.Sprintf("%s%s?%s", c.cfg.Address, V1Query, v.Encode())
-
-	headers := map[string]string{
-		"Content-Type": "application/x-www-form-urlencoded",
-	}
-	resp, respBody, err := c.client.Request("GET", _url, headers, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to request: %v", err)
-	}
-	if resp.StatusCode > 399 {
-		log.Printf("---> request: %s", _url)
-		log.Printf("<--- response status: %s", resp.Status)
-		return nil, fmt.Errorf("failed to request %s resp: %s; err: %v", V1Query, string(respBody), err)
-	}
-	err = json.Unmarshal(respBody, &response)
+	respBody, err := c.request(ctx, "GET", V1Query, v)
 	if err != nil {
 		return nil, err
 	}
-	return &response, nil
+	return parseQueryResponse(respBody)
 }
 
 func (c *Client) QueryRange(metric string, start, end time.Time, step string) (*QueryRangeResponse, error) {
-	var response QueryRangeResponse
+	return c.QueryRangeWithContext(context.Background(), metric, start, end, step)
+}
+
+func (c *Client) QueryRangeWithContext(ctx context.Context, metric string, start, end time.Time, step string) (*QueryRangeResponse, error) {
 	v := url.Values{}
 	v.Add("query", metric)
-	v.Add("start", start.Format(time.RFC3339))
-	v.Add("end", end.Format(time.RFC3339))
+	v.Add("start", formatTimestamp(start))
+	v.Add("end", formatTimestamp(end))
 	if len(step) != 0 {
 		v.Add("step", step)
 	}
 
-	_url := fmt.Sprintf("%s%s?%s", c.cfg.Address, V1QueryRange, v.Encode())
-
-	headers := map[string]string{
-		"Content-Type": "application/x-www-form-urlencoded",
-	}
-	resp, respBody, err := c.client.Request("GET", _url, headers, nil)
+	respBody, err := c.request(ctx, "GET", V1QueryRange, v)
 	if err != nil {
-		return nil, fmt.Errorf("failed to request: %v", err)
-	}
-	if resp.StatusCode > 399 {
-		log.Printf("---> request: %s", _url)
-		log.Printf("<--- response status: %s", resp.Status)
-		return nil, fmt.Errorf("failed to request %s resp: %s; err: %v", V1QueryRange, string(respBody), err)
+		return nil, err
 	}
-	err = json.Unmarshal(respBody, &response)
+	resp, err := parseQueryResponse(respBody)
 	if err != nil {
 		return nil, err
 	}
-	return &response, nil
+	return (*QueryRangeResponse)(resp), nil
 }
 
 func (c *Client) LabelValues(label string, match string) (*LabelValuesResponse, error) {
-	var response LabelValuesResponse
+	return c.LabelValuesWithContext(context.Background(), label, match)
+}
 
-	v := url.Values{}
-	v.Add("match[]=", match)
+func (c *Client) LabelValuesWithContext(ctx context.Context, label string, match string) (*LabelValuesResponse, error) {
+	var opts SeriesOptions
+	if len(match) != 0 {
+		opts.Matches = []string{match}
+	}
+	return c.LabelValuesWithOptions(ctx, label, opts)
+}
 
-	path := fmt.Sprintf(V1LabelValues, label)
-	_url := fmt.Sprintf("%s%s?%s", c.cfg.Address, path, v.Encode())
+// request sends a read request to the select address and returns the
+// response body, or an *APIError if the server answered with a non-2xx
+// status.
+func (c *Client) request(ctx context.Context, method, path string, v url.Values) ([]byte, error) {
+	_url, err := c.selectURL(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	_url += "?" + v.Encode()
 
 	headers := map[string]string{
 		"Content-Type": "application/x-www-form-urlencoded",
 	}
-	resp, respBody, err := c.client.Request("GET", _url, headers, nil)
+	resp, respBody, err := c.client.RequestWithContext(ctx, method, _url, headers, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to request: %v", err)
+		return nil, fmt.Errorf("failed to request %s: %w", path, err)
 	}
 	if resp.StatusCode > 399 {
-		log.Printf("---> request: %s", _url)
-		log.Printf("<--- response status: %s", resp.Status)
-		return nil, fmt.Errorf("failed to request %s resp: %s; err: %v", path, string(respBody), err)
+		return nil, newAPIError(resp.StatusCode, respBody)
 	}
+	return respBody, nil
+}
 
-	err = json.Unmarshal(respBody, &response)
+func parseQueryResponse(respBody []byte) (*QueryResponse, error) {
+	var response QueryResponse
+	err := json.Unmarshal(respBody, &response)
 	if err != nil {
 		return nil, err
 	}
-
+	if response.Status == StatusError {
+		return nil, &APIError{Type: response.ErrorType, Message: response.Error, Body: respBody}
+	}
 	return &response, nil
 }
 
+// MetricFormatter formats a single text exposition line with the job
+// label added. labels is not modified. When the line can't be validated the
+// failure is logged and the unvalidated line is returned as before.
+//
+// Deprecated: use FormatMetric, FormatSample or ExpositionWriter, which
+// report invalid names and values instead of producing a malformed line.
 func MetricFormatter(metric, job string, value any, timestamp int64, labels map[string]string) string {
-	labels["job"] = job
-	labs := make([]string, 0)
-	for k := range labels {
-		labs = append(labs, fmt.Sprintf("%s=\"%s\"", k, labels[k]))
+	line, err := FormatMetric(metric, job, value, timestamp, labels)
+	if err == nil {
+		return line
 	}
+	log.Warnf("failed to format metric %s: %v", metric, err)
+
+	labs := make([]string, 0, len(labels)+1)
+	for k, v := range labels {
+		if k != "job" {
+			labs = append(labs, fmt.Sprintf("%s=\"%s\"", k, v))
+		}
+	}
+	labs = append(labs, fmt.Sprintf("job=\"%s\"", job))
+	sort.Strings(labs)
 	return fmt.Sprintf("%s{%s} %v %d", metric, strings.Join(labs, ","), value, timestamp)
 }
 
-func (c *Client) Import(ctx context.Context, payload string) error {
-	_url := fmt.Sprintf("%s%s", c.cfg.InsertAddress, V1Import)
-
-	headers := map[string]string{
-		"Content-Type": "application/x-www-form-urlencoded",
+// FormatMetric formats a single text exposition line with the job label
+// added, like MetricFormatter, but returns an error for an invalid name or
+// a value that isn't a number. timestamp is in milliseconds.
+func FormatMetric(metric, job string, value any, timestamp int64, labels map[string]string) (string, error) {
+	labs := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		labs[k] = v
 	}
-	resp, respBody, err := c.client.RequestWithContext(ctx, "POST", _url, headers, []byte(payload))
+	labs["job"] = job
 
+	v, err := toFloat64(value)
 	if err != nil {
-		return fmt.Errorf("failed to request: %v req body: %s", err, payload)
+		return "", err
 	}
+	return FormatSample(metric, labs, v, time.UnixMilli(timestamp))
+}
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return nil
+func toFloat64(value any) (float64, error) {
+	switch value := value.(type) {
+	case float64:
+		return value, nil
+	case float32:
+		return float64(value), nil
+	case int:
+		return float64(value), nil
+	case int64:
+		return float64(value), nil
+	case int32:
+		return float64(value), nil
+	case uint64:
+		return float64(value), nil
+	case uint32:
+		return float64(value), nil
+	case bool:
+		if value {
+			return 1, nil
+		}
+		return 0, nil
 	}
-
-	return fmt.Errorf("vmagent returned error: %s req body: %s", respBody, payload)
+	v, err := strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported value %v (%T)", value, value)
+	}
+	return v, nil
 }
 
-func (c *Client) Write(ctx context.Context, payload []byte) error {
-	_url := fmt.Sprintf("%s%s", c.cfg.InsertAddress, V1Write)
+func (c *Client) Import(ctx context.Context, payload string) error {
+	_url, err := c.insertURL(ctx, V1Import)
+	if err != nil {
+		return err
+	}
 
 	headers := map[string]string{
-		"Content-Type": "application/x-protobuf",
+		"Content-Type": "application/x-www-form-urlencoded",
 	}
-	resp, respBody, err := c.client.RequestWithContext(ctx, "POST", _url, headers, snappy.Encode(nil, payload))
+	resp, respBody, err := c.client.RequestWithContext(ctx, "POST", _url, headers, []byte(payload))
 
 	if err != nil {
-		return fmt.Errorf("failed to request: %v", err)
+		return fmt.Errorf("failed to request: %v req body: %s", err, payload)
 	}
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		return nil
 	}
 
-	return fmt.Errorf("vmagent returned error: %s", respBody)
+	return newAPIErrorFromResponse(resp, respBody)
+}
+
+// Write sends a marshaled prompb.WriteRequest (remote write 1.0),
+// regardless of WithRemoteWriteVersion; use Send to honour it.
+func (c *Client) Write(ctx context.Context, payload []byte) error {
+	_, err := c.write(ctx, payload, RemoteWriteVersion1)
+	return err
 }
 
 func (c *Client) GetSelectAddress() string {
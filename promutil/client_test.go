@@ -0,0 +1,93 @@
+package promutil
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rosenlo/toolkits/http/httpclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientAuthOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	var auth, orgID string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		orgID = r.Header.Get("X-Scope-OrgID")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	assert.NoError(os.WriteFile(caFile, ca, 0o600))
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(os.WriteFile(tokenFile, []byte("first\n"), 0o600))
+
+	tlsConfig, err := httpclient.NewTLSConfig(httpclient.TLSConfig{CAFile: caFile})
+	assert.NoError(err)
+
+	c := NewClient(Config{InsertAddress: srv.URL},
+		WithHttpClient(httpclient.New(nil)),
+		WithTLSConfig(tlsConfig),
+		WithBearerTokenFile(tokenFile),
+		WithHeaders(map[string]string{"X-Scope-OrgID": "team-a"}),
+	)
+	ctx := context.Background()
+
+	assert.NoError(c.Write(ctx, nil))
+	assert.Equal("Bearer first", auth)
+	assert.Equal("team-a", orgID)
+
+	// a rotated token is picked up by the next request
+	assert.NoError(os.WriteFile(tokenFile, []byte("second"), 0o600))
+	assert.NoError(os.Chtimes(tokenFile, time.Now(), time.Now().Add(time.Second)))
+	assert.NoError(c.Import(ctx, "up 1"))
+	assert.Equal("Bearer second", auth)
+
+	// the TLS config is not leaked into the shared default transport
+	assert.Error(NewClient(Config{InsertAddress: srv.URL}).Write(ctx, nil))
+}
+
+func TestQueryTimeParameter(t *testing.T) {
+	assert := assert.New(t)
+
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{Address: srv.URL})
+	ctx := context.Background()
+
+	// timestamps at a whole minute used to be dropped
+	ts := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	_, err := c.QueryWithContext(ctx, "up", ts, "")
+	assert.NoError(err)
+	assert.Equal("1704164640", query.Get("time"))
+
+	_, err = c.QueryWithContext(ctx, "up", ts.Add(1500*time.Millisecond), "")
+	assert.NoError(err)
+	assert.Equal("1704164641.5", query.Get("time"))
+
+	_, err = c.QueryWithContext(ctx, "up", time.Time{}, "")
+	assert.NoError(err)
+	assert.False(query.Has("time"), "a zero time queries now")
+
+	resp, err := c.QueryRangeWithContext(ctx, "up", ts, ts.Add(time.Minute), "15")
+	assert.NoError(err)
+	assert.Equal("1704164640", query.Get("start"))
+	assert.Equal("1704164700", query.Get("end"))
+	assert.Equal(ValueTypeVector, resp.Data.ResultType)
+}
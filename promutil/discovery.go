@@ -0,0 +1,158 @@
+package promutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	V1Series      = "/api/v1/series"
+	V1Labels      = "/api/v1/labels"
+	V1Metadata    = "/api/v1/metadata"
+	V1StatusTSDB  = "/api/v1/status/tsdb"
+	V1SeriesCount = "/api/v1/series/count"
+)
+
+// SeriesOptions selects the series of the discovery endpoints. Zero
+// values are not sent.
+type SeriesOptions struct {
+	Matches []string
+	Start   time.Time
+	End     time.Time
+	Limit   int
+}
+
+func (o SeriesOptions) values() url.Values {
+	v := url.Values{}
+	for _, match := range o.Matches {
+		v.Add("match[]", match)
+	}
+	if !o.Start.IsZero() {
+		v.Add("start", formatTimestamp(o.Start))
+	}
+	if !o.End.IsZero() {
+		v.Add("end", formatTimestamp(o.End))
+	}
+	if o.Limit > 0 {
+		v.Add("limit", strconv.Itoa(o.Limit))
+	}
+	return v
+}
+
+type TSDBStatusOptions struct {
+	Matches []string
+	// Date selects the day to report on (VictoriaMetrics only).
+	Date time.Time
+	// TopN limits the number of entries per list.
+	TopN int
+	// FocusLabel fills SeriesCountByFocusLabelValue (VictoriaMetrics only).
+	FocusLabel string
+}
+
+func (o TSDBStatusOptions) values() url.Values {
+	v := url.Values{}
+	for _, match := range o.Matches {
+		v.Add("match[]", match)
+	}
+	if !o.Date.IsZero() {
+		v.Add("date", o.Date.UTC().Format(time.DateOnly))
+	}
+	if o.TopN > 0 {
+		v.Add("topN", strconv.Itoa(o.TopN))
+		v.Add("limit", strconv.Itoa(o.TopN))
+	}
+	if len(o.FocusLabel) != 0 {
+		v.Add("focusLabel", o.FocusLabel)
+	}
+	return v
+}
+
+// Series returns the label sets of the series matching opts.Matches.
+func (c *Client) Series(ctx context.Context, opts SeriesOptions) ([]map[string]string, error) {
+	if len(opts.Matches) == 0 {
+		return nil, fmt.Errorf("at least one match[] selector is required")
+	}
+	var response apiResponse[[]map[string]string]
+	if err := c.getJSON(ctx, V1Series, opts.values(), &response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// LabelNames returns the label names of the series matching opts.
+func (c *Client) LabelNames(ctx context.Context, opts SeriesOptions) ([]string, error) {
+	var response apiResponse[[]string]
+	if err := c.getJSON(ctx, V1Labels, opts.values(), &response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// LabelValuesWithOptions returns the values of label among the series
+// matching opts.
+func (c *Client) LabelValuesWithOptions(ctx context.Context, label string, opts SeriesOptions) (*LabelValuesResponse, error) {
+	var response LabelValuesResponse
+	if err := c.getJSON(ctx, fmt.Sprintf(V1LabelValues, url.PathEscape(label)), opts.values(), &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Metadata returns HELP/TYPE/UNIT per metric name. An empty metric
+// returns all of them, limit <= 0 means no limit.
+func (c *Client) Metadata(ctx context.Context, metric string, limit int) (map[string][]MetricMetadata, error) {
+	v := url.Values{}
+	if len(metric) != 0 {
+		v.Add("metric", metric)
+	}
+	if limit > 0 {
+		v.Add("limit", strconv.Itoa(limit))
+	}
+	var response apiResponse[map[string][]MetricMetadata]
+	if err := c.getJSON(ctx, V1Metadata, v, &response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// TSDBStatus returns the cardinality report of the storage.
+func (c *Client) TSDBStatus(ctx context.Context, opts TSDBStatusOptions) (*TSDBStatus, error) {
+	var response apiResponse[TSDBStatus]
+	if err := c.getJSON(ctx, V1StatusTSDB, opts.values(), &response); err != nil {
+		return nil, err
+	}
+	return &response.Data, nil
+}
+
+// SeriesCount returns the total number of series stored by
+// VictoriaMetrics. It may include deleted series.
+func (c *Client) SeriesCount(ctx context.Context) (uint64, error) {
+	var response apiResponse[[]uint64]
+	if err := c.getJSON(ctx, V1SeriesCount, url.Values{}, &response); err != nil {
+		return 0, err
+	}
+	if len(response.Data) == 0 {
+		return 0, fmt.Errorf("empty response from %s", V1SeriesCount)
+	}
+	return response.Data[0], nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v url.Values, response any) error {
+	respBody, err := c.request(ctx, "GET", path, v)
+	if err != nil {
+		return err
+	}
+
+	var envelope apiResponse[json.RawMessage]
+	if err := json.Unmarshal(respBody, &envelope); err != nil {
+		return err
+	}
+	if envelope.Status == StatusError {
+		return &APIError{Type: envelope.ErrorType, Message: envelope.Error, Body: respBody}
+	}
+	return json.Unmarshal(respBody, response)
+}
@@ -0,0 +1,58 @@
+package promutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case V1Series:
+			assert.Equal([]string{`up`, `process_start_time_seconds{job="node"}`}, r.URL.Query()["match[]"])
+			w.Write([]byte(`{"status":"success","data":[{"__name__":"up","job":"node"}]}`))
+		case "/api/v1/label/job/values":
+			assert.Equal([]string{"up"}, r.URL.Query()["match[]"])
+			w.Write([]byte(`{"status":"success","data":["node","vm"]}`))
+		case V1StatusTSDB:
+			assert.Equal("5", r.URL.Query().Get("topN"))
+			w.Write([]byte(`{"status":"success","data":{"totalSeries":42,"seriesCountByMetricName":[{"name":"up","value":40}]}}`))
+		case V1SeriesCount:
+			w.Write([]byte(`{"status":"success","data":[1234]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := NewClient(Config{Address: srv.URL})
+
+	series, err := c.Series(ctx, SeriesOptions{Matches: []string{`up`, `process_start_time_seconds{job="node"}`}})
+	assert.NoError(err)
+	assert.Equal([]map[string]string{{"__name__": "up", "job": "node"}}, series)
+
+	values, err := c.LabelValues("job", "up")
+	assert.NoError(err)
+	assert.Equal([]string{"node", "vm"}, values.Data)
+
+	status, err := c.TSDBStatus(ctx, TSDBStatusOptions{TopN: 5})
+	assert.NoError(err)
+	assert.Equal(uint64(42), status.TotalSeries)
+	assert.Equal([]TSDBStat{{Name: "up", Value: 40}}, status.SeriesCountByMetricName)
+
+	count, err := c.SeriesCount(ctx)
+	assert.NoError(err)
+	assert.Equal(uint64(1234), count)
+
+	_, err = c.Metadata(ctx, "up", 0)
+	var apiErr *APIError
+	assert.ErrorAs(err, &apiErr)
+	assert.Equal(http.StatusNotFound, apiErr.StatusCode)
+}
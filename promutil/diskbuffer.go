@@ -0,0 +1,448 @@
+package promutil
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rosenlo/toolkits/log"
+)
+
+const (
+	DefaultDiskBufferSegmentBytes   = 64 << 20
+	DefaultDiskBufferMaxBytes       = 1 << 30
+	DefaultDiskBufferMaxAge         = 24 * time.Hour
+	DefaultDiskBufferReplayInterval = 10 * time.Second
+
+	segmentSuffix    = ".seg"
+	lockFileName     = "LOCK"
+	recordHeaderSize = 8
+)
+
+var (
+	diskBufferBytes           *prometheus.GaugeVec
+	diskBufferDroppedSegments *prometheus.CounterVec
+)
+
+func init() {
+	diskBufferBytes, _ = NewGaugeVec("promutil_disk_buffer_bytes", "Bytes of write requests buffered on disk.", []string{"dir"})
+	diskBufferDroppedSegments, _ = NewCounterVec("promutil_disk_buffer_dropped_segments_total", "Segments dropped because of the size or age cap.", []string{"dir"})
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type DiskBufferConfig struct {
+	Dir string
+	// SegmentBytes is the size after which the active segment is sealed,
+	// at most MaxBytes.
+	SegmentBytes int64
+	// MaxBytes caps the total size on disk, the oldest segments are
+	// dropped once it is exceeded, the active one included.
+	MaxBytes int64
+	// MaxAge drops segments that were last written longer ago.
+	MaxAge time.Duration
+	// ReplayInterval is how often Run retries sending buffered requests.
+	ReplayInterval time.Duration
+}
+
+func (cfg *DiskBufferConfig) setDefaults() {
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = DefaultDiskBufferSegmentBytes
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultDiskBufferMaxBytes
+	}
+	if cfg.SegmentBytes > cfg.MaxBytes {
+		cfg.SegmentBytes = cfg.MaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultDiskBufferMaxAge
+	}
+	if cfg.ReplayInterval <= 0 {
+		cfg.ReplayInterval = DefaultDiskBufferReplayInterval
+	}
+}
+
+type segment struct {
+	seq  int
+	size int64
+}
+
+// DiskBuffer writes requests through to the client and spills them to
+// segment files on disk while the backend is unavailable. Buffered
+// requests are replayed in order by Run and survive restarts. Delivery is
+// at-least-once: a segment interrupted mid-replay is resent from the
+// start after a restart. The directory is locked, so it can't be shared by
+// two buffers.
+type DiskBuffer struct {
+	client *Client
+	cfg    DiskBufferConfig
+	lock   io.Closer
+
+	// writeMu serializes Write, so requests reach the backend or the disk
+	// in the order Write was called.
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	sealed   []segment
+	active   *os.File
+	activeSz int64
+	nextSeq  int
+
+	// replayed is the offset already sent of the oldest sealed segment.
+	replayed int64
+
+	bytes   prometheus.Gauge
+	dropped prometheus.Counter
+}
+
+func NewDiskBuffer(client *Client, cfg DiskBufferConfig) (*DiskBuffer, error) {
+	cfg.setDefaults()
+	if len(cfg.Dir) == 0 {
+		return nil, fmt.Errorf("disk buffer dir is required")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(cfg.Dir, lockFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock disk buffer dir %s: %w", cfg.Dir, err)
+	}
+
+	b := &DiskBuffer{
+		client:  client,
+		cfg:     cfg,
+		lock:    lock,
+		bytes:   diskBufferBytes.WithLabelValues(cfg.Dir),
+		dropped: diskBufferDroppedSegments.WithLabelValues(cfg.Dir),
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		if info.Size() == 0 {
+			os.Remove(filepath.Join(cfg.Dir, name))
+			continue
+		}
+		b.sealed = append(b.sealed, segment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(b.sealed, func(i, j int) bool { return b.sealed[i].seq < b.sealed[j].seq })
+	if len(b.sealed) > 0 {
+		b.nextSeq = b.sealed[len(b.sealed)-1].seq + 1
+	}
+	b.updateBytes()
+
+	return b, nil
+}
+
+// Write sends req directly while nothing is buffered. If the backend
+// fails with a recoverable error, or older requests are still pending, req
+// is appended to disk instead and nil is returned.
+func (b *DiskBuffer) Write(ctx context.Context, req *prompb.WriteRequest) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	if b.Pending() == 0 {
+		err := b.client.Send(ctx, req)
+		if err == nil {
+			return nil
+		}
+		if !recoverable(err) {
+			return err
+		}
+		log.Warnf("[%s] remote write failed, buffering on disk: %v", b.cfg.Dir, err)
+	}
+
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return b.append(data)
+}
+
+// Pending returns the number of bytes buffered on disk.
+func (b *DiskBuffer) Pending() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pendingLocked()
+}
+
+func (b *DiskBuffer) pendingLocked() int64 {
+	total := b.activeSz
+	for _, s := range b.sealed {
+		total += s.size
+	}
+	return total
+}
+
+func (b *DiskBuffer) append(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active == nil {
+		f, err := os.OpenFile(b.segmentPath(b.nextSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		b.active = f
+		b.activeSz = 0
+	}
+
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:recordHeaderSize], crc32.Checksum(data, crcTable))
+	copy(record[recordHeaderSize:], data)
+	if _, err := b.active.Write(record); err != nil {
+		// a partial record would hide every later one from replay
+		if terr := b.active.Truncate(b.activeSz); terr != nil {
+			log.Warnf("[%s] failed to truncate segment %d: %v", b.cfg.Dir, b.nextSeq, terr)
+			b.retireActiveLocked()
+		}
+		return err
+	}
+	b.activeSz += int64(recordHeaderSize + len(data))
+
+	if b.activeSz >= b.cfg.SegmentBytes {
+		if err := b.sealLocked(); err != nil {
+			return err
+		}
+	}
+	b.enforceCapsLocked()
+	b.updateBytes()
+	return nil
+}
+
+func (b *DiskBuffer) sealLocked() error {
+	if b.active == nil {
+		return nil
+	}
+	if err := b.active.Sync(); err != nil {
+		return err
+	}
+	if err := b.active.Close(); err != nil {
+		return err
+	}
+	b.sealed = append(b.sealed, segment{seq: b.nextSeq, size: b.activeSz})
+	b.active = nil
+	b.activeSz = 0
+	b.nextSeq++
+	return nil
+}
+
+// retireActiveLocked closes the active segment after a failed write, so
+// later records go to a new one. Its complete records are kept; replay
+// stops at the partial one at its end.
+func (b *DiskBuffer) retireActiveLocked() {
+	b.active.Close()
+	if b.activeSz > 0 {
+		b.sealed = append(b.sealed, segment{seq: b.nextSeq, size: b.activeSz})
+	} else {
+		os.Remove(b.segmentPath(b.nextSeq))
+	}
+	b.active = nil
+	b.activeSz = 0
+	b.nextSeq++
+}
+
+func (b *DiskBuffer) enforceCapsLocked() {
+	now := time.Now()
+	for {
+		if len(b.sealed) == 0 {
+			if b.activeSz <= b.cfg.MaxBytes {
+				return
+			}
+			// the active segment alone is over the cap, seal it to drop it
+			if err := b.sealLocked(); err != nil {
+				log.Warnf("[%s] failed to seal segment: %v", b.cfg.Dir, err)
+				return
+			}
+		}
+		oldest := b.sealed[0]
+		path := b.segmentPath(oldest.seq)
+		expired := false
+		if info, err := os.Stat(path); err == nil {
+			expired = now.Sub(info.ModTime()) > b.cfg.MaxAge
+		}
+		if !expired && b.pendingLocked() <= b.cfg.MaxBytes {
+			return
+		}
+		log.Warnf("[%s] dropping buffered segment %s", b.cfg.Dir, path)
+		os.Remove(path)
+		b.sealed = b.sealed[1:]
+		b.replayed = 0
+		b.dropped.Inc()
+	}
+}
+
+// Run replays buffered requests every ReplayInterval until ctx is
+// cancelled.
+func (b *DiskBuffer) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := b.Replay(ctx); err != nil && ctx.Err() == nil {
+			log.Warnf("[%s] replay stopped: %v", b.cfg.Dir, err)
+		}
+	}
+}
+
+// Replay sends buffered segments in order, deleting each one once all of
+// its requests were accepted. It stops at the first recoverable error and
+// resumes from the same request on the next call. The active segment is
+// only sealed and sent once the sealed ones are, so an outage doesn't pile
+// up small segments.
+func (b *DiskBuffer) Replay(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		b.enforceCapsLocked()
+		if len(b.sealed) == 0 {
+			if b.activeSz == 0 {
+				b.updateBytes()
+				b.mu.Unlock()
+				return nil
+			}
+			if err := b.sealLocked(); err != nil {
+				b.mu.Unlock()
+				return err
+			}
+		}
+		b.updateBytes()
+		seg := b.sealed[0]
+		offset := b.replayed
+		b.mu.Unlock()
+
+		offset, err := b.replaySegment(ctx, seg, offset)
+
+		b.mu.Lock()
+		if len(b.sealed) == 0 || b.sealed[0].seq != seg.seq {
+			// dropped by the caps while it was being replayed
+			b.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			b.replayed = offset
+			b.mu.Unlock()
+			return err
+		}
+		b.sealed = b.sealed[1:]
+		b.replayed = 0
+		os.Remove(b.segmentPath(seg.seq))
+		b.updateBytes()
+		b.mu.Unlock()
+	}
+}
+
+// replaySegment sends the records of seg starting at offset and returns
+// the offset of the first record that wasn't accepted.
+func (b *DiskBuffer) replaySegment(ctx context.Context, seg segment, offset int64) (int64, error) {
+	f, err := os.Open(b.segmentPath(seg.seq))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	r := bufio.NewReader(f)
+	var header [recordHeaderSize]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			log.Warnf("[%s] truncated record in segment %d: %v", b.cfg.Dir, seg.seq, err)
+			return offset, nil
+		}
+		// the length isn't covered by the checksum, check it before
+		// allocating
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		if size > info.Size()-offset-recordHeaderSize {
+			log.Warnf("[%s] corrupt record length %d in segment %d, skipping rest of segment", b.cfg.Dir, size, seg.seq)
+			return offset, nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			log.Warnf("[%s] truncated record in segment %d: %v", b.cfg.Dir, seg.seq, err)
+			return offset, nil
+		}
+		if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+			log.Warnf("[%s] corrupt record in segment %d, skipping rest of segment", b.cfg.Dir, seg.seq)
+			return offset, nil
+		}
+
+		err = b.client.sendPayload(ctx, data)
+		if err != nil && !recoverable(err) {
+			log.Errorf("[%s] dropping buffered request: %v", b.cfg.Dir, err)
+		} else if err != nil {
+			return offset, err
+		}
+		offset += int64(recordHeaderSize + len(data))
+	}
+}
+
+// Close seals the active segment so it is replayed after a restart and
+// releases the directory.
+func (b *DiskBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.sealLocked()
+	if b.lock != nil {
+		err = errors.Join(err, b.lock.Close())
+		b.lock = nil
+	}
+	return err
+}
+
+func (b *DiskBuffer) segmentPath(seq int) string {
+	return filepath.Join(b.cfg.Dir, fmt.Sprintf("%08d%s", seq, segmentSuffix))
+}
+
+func (b *DiskBuffer) updateBytes() {
+	b.bytes.Set(float64(b.pendingLocked()))
+}
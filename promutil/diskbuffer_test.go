@@ -0,0 +1,262 @@
+package promutil
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskBufferReplayInOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	var down atomic.Bool
+	var mu sync.Mutex
+	var received []float64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		data, _ := snappy.Decode(nil, compressed)
+		var req prompb.WriteRequest
+		assert.NoError(proto.Unmarshal(data, &req))
+		mu.Lock()
+		received = append(received, req.Timeseries[0].Samples[0].Value)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	client := NewClient(Config{InsertAddress: srv.URL})
+	newReq := func(v float64) *prompb.WriteRequest {
+		return &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: v}},
+		}}}
+	}
+
+	b, err := NewDiskBuffer(client, DiskBufferConfig{Dir: dir, SegmentBytes: 64})
+	assert.NoError(err)
+
+	ctx := context.Background()
+	assert.NoError(b.Write(ctx, newReq(1)))
+	down.Store(true)
+	for _, v := range []float64{2, 3, 4, 5} {
+		assert.NoError(b.Write(ctx, newReq(v)))
+	}
+	assert.NotZero(b.Pending())
+	assert.Error(b.Replay(ctx))
+	assert.NoError(b.Close())
+
+	// reopen to simulate a restart
+	b, err = NewDiskBuffer(client, DiskBufferConfig{Dir: dir, SegmentBytes: 64})
+	assert.NoError(err)
+	down.Store(false)
+	assert.NoError(b.Write(ctx, newReq(6)))
+	assert.NoError(b.Replay(ctx))
+
+	assert.Zero(b.Pending())
+	assert.Equal([]float64{1, 2, 3, 4, 5, 6}, received)
+}
+
+func TestDiskBufferConcurrentWriteOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+	var mu sync.Mutex
+	var received []float64
+	first, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(first)
+			<-release
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		data, _ := snappy.Decode(nil, compressed)
+		var req prompb.WriteRequest
+		assert.NoError(proto.Unmarshal(data, &req))
+		mu.Lock()
+		received = append(received, req.Timeseries[0].Samples[0].Value)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	b, err := NewDiskBuffer(NewClient(Config{InsertAddress: srv.URL}), DiskBufferConfig{Dir: t.TempDir()})
+	assert.NoError(err)
+	defer b.Close()
+
+	ctx := context.Background()
+	write := func(v float64) {
+		assert.NoError(b.Write(ctx, &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: v}},
+		}}}))
+	}
+
+	// the second write must not overtake the first, which fails and is
+	// buffered
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		write(1)
+	}()
+	<-first
+	go func() {
+		defer wg.Done()
+		write(2)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.NoError(b.Replay(ctx))
+	assert.Equal([]float64{1, 2}, received)
+}
+
+func TestDiskBufferSegmentsAndCaps(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	client := NewClient(Config{InsertAddress: srv.URL})
+
+	ctx := context.Background()
+	write := func(b *DiskBuffer, v float64) {
+		assert.NoError(b.Write(ctx, &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: v}},
+		}}}))
+	}
+
+	dir := t.TempDir()
+	b, err := NewDiskBuffer(client, DiskBufferConfig{Dir: dir})
+	assert.NoError(err)
+
+	// the directory can't be shared
+	_, err = NewDiskBuffer(client, DiskBufferConfig{Dir: dir})
+	assert.Error(err)
+
+	// failing replays don't seal a new segment each time
+	for i := 0; i < 20; i++ {
+		write(b, float64(i))
+		assert.Error(b.Replay(ctx))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Len(files, 2)
+
+	assert.NoError(b.Close())
+	b, err = NewDiskBuffer(client, DiskBufferConfig{Dir: dir})
+	assert.NoError(err)
+	assert.NoError(b.Close())
+
+	// SegmentBytes larger than MaxBytes doesn't lift the cap
+	b, err = NewDiskBuffer(client, DiskBufferConfig{Dir: t.TempDir(), SegmentBytes: 1 << 20, MaxBytes: 200})
+	assert.NoError(err)
+	defer b.Close()
+	for i := 0; i < 20; i++ {
+		write(b, float64(i))
+		assert.LessOrEqual(b.Pending(), int64(200))
+	}
+	assert.NotZero(b.Pending())
+}
+
+func TestDiskBufferFailedAppend(t *testing.T) {
+	assert := assert.New(t)
+
+	var down atomic.Bool
+	down.Store(true)
+	sink := NewMemorySink()
+	receiver := NewReceiver(sink)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	b, err := NewDiskBuffer(NewClient(Config{InsertAddress: srv.URL}), DiskBufferConfig{Dir: dir})
+	assert.NoError(err)
+	defer b.Close()
+
+	ctx := context.Background()
+	write := func(v float64) error {
+		return b.Write(ctx, &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: v}},
+		}}})
+	}
+	assert.NoError(write(1))
+
+	// a segment that can neither be written nor truncated is retired
+	b.mu.Lock()
+	b.active.Close()
+	b.active, err = os.Open(b.segmentPath(b.nextSeq))
+	b.mu.Unlock()
+	assert.NoError(err)
+	assert.Error(write(2))
+	assert.NoError(write(3))
+
+	down.Store(false)
+	assert.NoError(b.Replay(ctx))
+	assert.Zero(b.Pending())
+	var values []float64
+	for _, ts := range sink.Find("up") {
+		values = append(values, ts.Samples[0].Value)
+	}
+	assert.Equal([]float64{1, 3}, values)
+}
+
+func TestDiskBufferCorruptLength(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := NewMemorySink()
+	srv := httptest.NewServer(NewReceiver(sink))
+	defer srv.Close()
+
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1}},
+	}}})
+	assert.NoError(err)
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:recordHeaderSize], crc32.Checksum(data, crcTable))
+	copy(record[recordHeaderSize:], data)
+	// a header claiming 4 GiB follows the valid record
+	corrupt := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+
+	dir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(dir, "00000000"+segmentSuffix), append(record, corrupt...), 0o644))
+	b, err := NewDiskBuffer(NewClient(Config{InsertAddress: srv.URL}), DiskBufferConfig{Dir: dir})
+	assert.NoError(err)
+	defer b.Close()
+
+	assert.NoError(b.Replay(context.Background()))
+	assert.Zero(b.Pending())
+	assert.Len(sink.Find("up"), 1)
+}
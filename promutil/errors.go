@@ -0,0 +1,78 @@
+package promutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIError is returned when the server answers with a non-2xx status or
+// the Prometheus HTTP API responds with status "error".
+type APIError struct {
+	StatusCode int
+	Type       string
+	Message    string
+	Body       []byte
+	// RetryAfter is parsed from the Retry-After header of 429 and 5xx
+	// responses.
+	RetryAfter time.Duration
+}
+
+func newAPIErrorFromResponse(resp *http.Response, body []byte) *APIError {
+	e := newAPIError(resp.StatusCode, body)
+	e.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	return e
+}
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	e := &APIError{StatusCode: statusCode, Body: body}
+	var response struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Error     string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err == nil && response.Status == StatusError {
+		e.Type = response.ErrorType
+		e.Message = response.Error
+	}
+	return e
+}
+
+// Recoverable reports whether the request may succeed if retried, which is
+// the case for 429 and 5xx responses.
+func (e *APIError) Recoverable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// recoverable reports whether a failed write may succeed if retried:
+// network errors and recoverable API errors are, partial writes are not.
+func recoverable(err error) bool {
+	if errors.Is(err, ErrPartialWrite) {
+		return false
+	}
+	var apiErr *APIError
+	return !errors.As(err, &apiErr) || apiErr.Recoverable()
+}
+
+func (e *APIError) Error() string {
+	if len(e.Type) != 0 {
+		return fmt.Sprintf("%s: %s (status %d)", e.Type, e.Message, e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), string(e.Body))
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
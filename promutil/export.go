@@ -0,0 +1,257 @@
+package promutil
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	V1ImportJSON = "/api/v1/import"
+
+	DefaultWriteBatchSamples = 10000
+)
+
+// ErrStopExport can be returned from an ExportStream callback to stop
+// reading without reporting an error.
+var ErrStopExport = errors.New("stop export")
+
+type ExportOptions struct {
+	Matches        []string
+	Start          time.Time
+	End            time.Time
+	ReduceMemUsage bool
+	MaxRowsPerLine int
+}
+
+func (o ExportOptions) values() url.Values {
+	v := url.Values{}
+	for _, match := range o.Matches {
+		v.Add("match[]", match)
+	}
+	if !o.Start.IsZero() {
+		v.Add("start", formatTimestamp(o.Start))
+	}
+	if !o.End.IsZero() {
+		v.Add("end", formatTimestamp(o.End))
+	}
+	if o.ReduceMemUsage {
+		v.Add("reduce_mem_usage", "1")
+	}
+	if o.MaxRowsPerLine > 0 {
+		v.Add("max_rows_per_line", strconv.Itoa(o.MaxRowsPerLine))
+	}
+	return v
+}
+
+// ExportStream reads the JSON lines returned by /api/v1/export one at a
+// time and passes each decoded Sample to fn, so the whole response is
+// never held in memory.
+func (c *Client) ExportStream(ctx context.Context, opts ExportOptions, fn func(*Sample) error) error {
+	if len(opts.Matches) == 0 {
+		return fmt.Errorf("at least one match[] selector is required")
+	}
+
+	_url, err := c.selectURL(ctx, V1Export)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}
+	resp, err := c.client.StreamWithContext(ctx, "POST", _url, headers, []byte(opts.values().Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", V1Export, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 399 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, respBody)
+	}
+
+	return DecodeSamples(resp.Body, fn)
+}
+
+// DecodeSamples decodes VictoriaMetrics JSON line samples from r and calls
+// fn for each of them.
+func DecodeSamples(r io.Reader, fn func(*Sample) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		sample := new(Sample)
+		err := dec.Decode(sample)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode sample: %w", err)
+		}
+		if len(sample.Values) != len(sample.Timestamps) {
+			return fmt.Errorf("sample %v has %d values but %d timestamps", sample.Metric, len(sample.Values), len(sample.Timestamps))
+		}
+		err = fn(sample)
+		if errors.Is(err, ErrStopExport) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ImportSamples writes samples to /api/v1/import using the same JSON line
+// format produced by ExportStream.
+func (c *Client) ImportSamples(ctx context.Context, samples []*Sample) error {
+	return c.ImportSamplesStream(ctx, func(write func(*Sample) error) error {
+		for _, sample := range samples {
+			if err := write(sample); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportSamplesStream streams the samples fn passes to write to
+// /api/v1/import through a pipe, so copying an export never holds more
+// than one sample in memory:
+//
+//	err := dst.ImportSamplesStream(ctx, func(write func(*Sample) error) error {
+//		return src.ExportStream(ctx, opts, write)
+//	})
+func (c *Client) ImportSamplesStream(ctx context.Context, fn func(write func(*Sample) error) error) error {
+	_url, err := c.insertURL(ctx, V1ImportJSON)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		bw := bufio.NewWriter(pw)
+		enc := json.NewEncoder(bw)
+		err := fn(func(sample *Sample) error {
+			if err := enc.Encode(sample); err != nil {
+				return fmt.Errorf("failed to encode sample: %w", err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	headers := map[string]string{
+		"Content-Type": "application/stream+json",
+	}
+	resp, err := c.client.DoWithContext(ctx, "POST", _url, headers, pr)
+	// unblock the producer if the request failed before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	if fnErr := <-done; fnErr != nil && !errors.Is(fnErr, io.ErrClosedPipe) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", V1ImportJSON, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	return newAPIErrorFromResponse(resp, respBody)
+}
+
+// WriteSamplesStream remote-writes the samples fn passes to write in
+// requests of at most batchSamples samples, defaulting to
+// DefaultWriteBatchSamples, so only one batch is held in memory. Like
+// ImportSamplesStream it can be fed by ExportStream.
+func (c *Client) WriteSamplesStream(ctx context.Context, batchSamples int, fn func(write func(*Sample) error) error) error {
+	if batchSamples <= 0 {
+		batchSamples = DefaultWriteBatchSamples
+	}
+
+	req := &prompb.WriteRequest{}
+	pending := 0
+	flush := func() error {
+		if len(req.Timeseries) == 0 {
+			return nil
+		}
+		err := c.Send(ctx, req)
+		req.Timeseries = req.Timeseries[:0]
+		pending = 0
+		return err
+	}
+
+	err := fn(func(sample *Sample) error {
+		ts := sample.TimeSeries()
+		// long samples are split over several requests
+		for len(ts.Samples) > 0 {
+			n := min(batchSamples-pending, len(ts.Samples))
+			req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: ts.Labels, Samples: ts.Samples[:n]})
+			ts.Samples = ts.Samples[n:]
+			pending += n
+			if pending >= batchSamples {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// TimeSeries converts the sample into a remote write series.
+func (s *Sample) TimeSeries() prompb.TimeSeries {
+	ts := prompb.TimeSeries{
+		Labels:  make([]prompb.Label, 0, len(s.Metric)),
+		Samples: make([]prompb.Sample, 0, len(s.Values)),
+	}
+	for name, value := range s.Metric {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: value})
+	}
+	sortLabels(ts.Labels)
+	for i := range s.Values {
+		ts.Samples = append(ts.Samples, prompb.Sample{
+			Value:     s.Values[i],
+			Timestamp: s.Timestamps[i],
+		})
+	}
+	return ts
+}
+
+// SamplesToWriteRequest converts exported samples into a WriteRequest that
+// can be sent with BatchRemoteWrite. Use WriteSamplesStream to write an
+// export without collecting it first.
+func SamplesToWriteRequest(samples []*Sample) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(samples))}
+	for _, sample := range samples {
+		req.Timeseries = append(req.Timeseries, sample.TimeSeries())
+	}
+	return req
+}
+
+func sortLabels(labels []prompb.Label) {
+	slices.SortFunc(labels, func(a, b prompb.Label) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
@@ -0,0 +1,96 @@
+package promutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newExportServer(n int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := json.NewEncoder(w)
+		for i := 0; i < n; i++ {
+			enc.Encode(Sample{
+				Metric:     map[string]string{"__name__": "up", "i": string(rune('a' + i%26))},
+				Values:     []float64{1, 2, 3},
+				Timestamps: []int64{1000, 2000, int64(3000 + i)},
+			})
+		}
+	}))
+}
+
+func TestExportToImport(t *testing.T) {
+	assert := assert.New(t)
+
+	src := newExportServer(1000)
+	defer src.Close()
+
+	var imported atomic.Int64
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("application/stream+json", r.Header.Get("Content-Type"))
+		err := DecodeSamples(r.Body, func(s *Sample) error {
+			imported.Add(int64(len(s.Values)))
+			return nil
+		})
+		assert.NoError(err)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer dst.Close()
+
+	ctx := context.Background()
+	srcClient := NewClient(Config{Address: src.URL})
+	dstClient := NewClient(Config{InsertAddress: dst.URL})
+	opts := ExportOptions{Matches: []string{"up"}}
+
+	err := dstClient.ImportSamplesStream(ctx, func(write func(*Sample) error) error {
+		return srcClient.ExportStream(ctx, opts, write)
+	})
+	assert.NoError(err)
+	assert.Equal(int64(3000), imported.Load())
+
+	// an error of the producer fails the import
+	errExport := errors.New("export failed")
+	err = dstClient.ImportSamplesStream(ctx, func(write func(*Sample) error) error {
+		return errExport
+	})
+	assert.ErrorIs(err, errExport)
+}
+
+func TestExportToRemoteWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	src := newExportServer(1000)
+	defer src.Close()
+
+	var requests atomic.Int64
+	sink := NewMemorySink()
+	receiver := NewReceiver(sink)
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		receiver.ServeHTTP(w, r)
+	}))
+	defer dst.Close()
+
+	ctx := context.Background()
+	srcClient := NewClient(Config{Address: src.URL})
+	dstClient := NewClient(Config{InsertAddress: dst.URL})
+	opts := ExportOptions{Matches: []string{"up"}}
+
+	err := dstClient.WriteSamplesStream(ctx, 200, func(write func(*Sample) error) error {
+		return srcClient.ExportStream(ctx, opts, write)
+	})
+	assert.NoError(err)
+	assert.Equal(int64(15), requests.Load())
+
+	total := 0
+	for _, ts := range sink.Series() {
+		total += len(ts.Samples)
+	}
+	assert.Equal(3000, total)
+}
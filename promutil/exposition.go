@@ -0,0 +1,214 @@
+package promutil
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+type ExpositionFormat int
+
+const (
+	FormatText ExpositionFormat = iota
+	FormatOpenMetrics
+)
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	textHelpEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// ExpositionWriter writes validated Prometheus text exposition or
+// OpenMetrics lines to w. Label values are escaped and labels are sorted
+// by name. The first error is sticky and returned by every later call.
+type ExpositionWriter struct {
+	w      *bufio.Writer
+	format ExpositionFormat
+	err    error
+}
+
+func NewExpositionWriter(w io.Writer, format ExpositionFormat) *ExpositionWriter {
+	return &ExpositionWriter{w: bufio.NewWriter(w), format: format}
+}
+
+// Family writes the HELP and TYPE lines of a metric family. An empty help
+// omits the HELP line.
+func (e *ExpositionWriter) Family(name, help string, typ model.MetricType) error {
+	if e.err != nil {
+		return e.err
+	}
+	if !model.IsValidLegacyMetricName(name) {
+		e.err = fmt.Errorf("invalid metric name %q", name)
+		return e.err
+	}
+
+	if len(help) != 0 {
+		escaped := textHelpEscaper.Replace(help)
+		if e.format == FormatOpenMetrics {
+			escaped = labelValueEscaper.Replace(help)
+		}
+		e.writeString("# HELP " + name + " " + escaped + "\n")
+	}
+	if len(typ) != 0 {
+		if e.format == FormatText && typ == model.MetricTypeUnknown {
+			e.writeString("# TYPE " + name + " untyped\n")
+		} else {
+			e.writeString("# TYPE " + name + " " + string(typ) + "\n")
+		}
+	}
+	return e.err
+}
+
+// Sample writes one sample line. A zero timestamp omits it; otherwise it
+// is written in milliseconds for the text format and in seconds with
+// millisecond precision for OpenMetrics.
+func (e *ExpositionWriter) Sample(name string, labels map[string]string, value float64, timestamp time.Time) error {
+	if e.err != nil {
+		return e.err
+	}
+	if !model.IsValidLegacyMetricName(name) {
+		e.err = fmt.Errorf("invalid metric name %q", name)
+		return e.err
+	}
+
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		if !model.LabelName(k).IsValidLegacy() || k == model.MetricNameLabel {
+			e.err = fmt.Errorf("invalid label name %q", k)
+			return e.err
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(names) > 0 {
+		sb.WriteByte('{')
+		for i, k := range names {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(k)
+			sb.WriteString(`="`)
+			sb.WriteString(labelValueEscaper.Replace(labels[k]))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatValue(value))
+	if !timestamp.IsZero() {
+		sb.WriteByte(' ')
+		if e.format == FormatOpenMetrics {
+			sb.WriteString(formatTimestamp(timestamp))
+		} else {
+			sb.WriteString(strconv.FormatInt(timestamp.UnixMilli(), 10))
+		}
+	}
+	sb.WriteByte('\n')
+
+	e.writeString(sb.String())
+	return e.err
+}
+
+// Close flushes buffered lines and, for OpenMetrics, writes the
+// terminating "# EOF" line. It does not close the underlying writer.
+func (e *ExpositionWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.format == FormatOpenMetrics {
+		e.writeString("# EOF\n")
+	}
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+func (e *ExpositionWriter) writeString(s string) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.WriteString(s)
+}
+
+// FormatSample returns a single text exposition line without the
+// trailing newline.
+func FormatSample(name string, labels map[string]string, value float64, timestamp time.Time) (string, error) {
+	var sb strings.Builder
+	w := NewExpositionWriter(&sb, FormatText)
+	if err := w.Sample(name, labels, value, timestamp); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(sb.String(), "\n"), nil
+}
+
+// ImportStream streams the lines written by fn to /api/v1/import/prometheus
+// without building the whole payload in memory.
+func (c *Client) ImportStream(ctx context.Context, fn func(w *ExpositionWriter) error) error {
+	_url, err := c.insertURL(ctx, V1Import)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		w := NewExpositionWriter(pw, FormatText)
+		err := fn(w)
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	headers := map[string]string{
+		"Content-Type": "text/plain",
+	}
+	resp, err := c.client.DoWithContext(ctx, "POST", _url, headers, pr)
+	// unblock the producer if the request failed before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	if fnErr := <-done; fnErr != nil && !errors.Is(fnErr, io.ErrClosedPipe) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", V1Import, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	return newAPIErrorFromResponse(resp, respBody)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
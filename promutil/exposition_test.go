@@ -0,0 +1,86 @@
+package promutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpositionWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var sb strings.Builder
+	w := NewExpositionWriter(&sb, FormatText)
+	assert.NoError(w.Family("test_metric", "multi\nline \\ help", model.MetricTypeGauge))
+	assert.NoError(w.Sample("test_metric", map[string]string{"z": "1", "a": "say \"hi\"\n"}, math.Inf(1), time.UnixMilli(1700000000123)))
+	assert.NoError(w.Close())
+	assert.Equal(`# HELP test_metric multi\nline \\ help
+# TYPE test_metric gauge
+test_metric{a="say \"hi\"\n",z="1"} +Inf 1700000000123
+`, sb.String())
+
+	sb.Reset()
+	w = NewExpositionWriter(&sb, FormatOpenMetrics)
+	assert.NoError(w.Sample("test_metric", nil, 0.5, time.UnixMilli(1700000000123)))
+	assert.NoError(w.Close())
+	assert.Equal("test_metric 0.5 1700000000.123\n# EOF\n", sb.String())
+
+	w = NewExpositionWriter(&sb, FormatText)
+	assert.Error(w.Sample("bad-name", nil, 1, time.Time{}))
+	assert.Error(w.Close())
+}
+
+func TestMetricFormatterDoesNotMutateLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	labels := map[string]string{"b": "2", "a": "1"}
+	line := MetricFormatter("test_metric", "job", 3, 1000, labels)
+	assert.Equal(`test_metric{a="1",b="2",job="job"} 3 1000`, line)
+	assert.NotContains(labels, "job")
+}
+
+func TestFormatMetricErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := FormatMetric("bad-name", "job", 1, 1000, nil)
+	assert.Error(err)
+	_, err = FormatMetric("test_metric", "job", "n/a", 1000, nil)
+	assert.Error(err)
+
+	// MetricFormatter keeps the unvalidated line rather than dropping it
+	assert.Equal(`bad-name{a="1",job="job"} 1 1000`, MetricFormatter("bad-name", "job", 1, 1000, map[string]string{"a": "1"}))
+	assert.Equal(`test_metric{job="job"} n/a 1000`, MetricFormatter("test_metric", "job", "n/a", 1000, nil))
+}
+
+func TestImportStream(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, sink := newTestReceiver()
+	defer srv.Close()
+	client := NewClient(Config{InsertAddress: srv.URL})
+
+	err := client.ImportStream(context.Background(), func(w *ExpositionWriter) error {
+		for i := 0; i < 100; i++ {
+			if err := w.Sample("test_stream", map[string]string{"i": fmt.Sprint(i)}, float64(i), time.UnixMilli(1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Len(sink.Find("test_stream"), 100)
+
+	// an error of fn is returned as is
+	errProduce := errors.New("produce failed")
+	err = client.ImportStream(context.Background(), func(w *ExpositionWriter) error {
+		return errProduce
+	})
+	assert.Equal(errProduce, err)
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package promutil
+
+import (
+	"io"
+	"os"
+)
+
+type lockedFile struct {
+	*os.File
+}
+
+func (f lockedFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// lockFile creates path exclusively and removes it on Close. Unlike the
+// unix lock, it is left behind if the process dies.
+func lockFile(path string) (io.Closer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return lockedFile{f}, nil
+}
@@ -0,0 +1,108 @@
+package promutil
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rosenlo/toolkits/log"
+)
+
+const MetricsPath = "/metrics"
+
+type MetricsHandlerConfig struct {
+	// Registry defaults to prometheus.DefaultRegisterer and
+	// prometheus.DefaultGatherer.
+	Registry *prometheus.Registry
+	// Namespace prefixes the build_info metric.
+	Namespace string
+	// ErrorHandling defaults to promhttp.HTTPErrorOnError.
+	ErrorHandling promhttp.HandlerErrorHandling
+	// Timeout of a single scrape, unlimited by default.
+	Timeout time.Duration
+	// MaxRequestsInFlight limits concurrent scrapes, unlimited by default.
+	MaxRequestsInFlight int
+	DisableCompression  bool
+}
+
+// NewMetricsHandler registers the process, Go and build_info collectors
+// and returns a handler serving the registry, to be mounted on
+// MetricsPath:
+//
+//	mux := http.NewServeMux()
+//	mux.Handle(promutil.MetricsPath, handler)
+//	srv := httpserver.NewServer(addr, mux)
+//
+// OpenMetrics, and with it exemplars, is served when the scraper asks for
+// it; responses are gzip-compressed when accepted. Collectors that are
+// already registered are reused.
+func NewMetricsHandler(cfg MetricsHandlerConfig) (http.Handler, error) {
+	var (
+		reg      prometheus.Registerer = prometheus.DefaultRegisterer
+		gatherer prometheus.Gatherer   = prometheus.DefaultGatherer
+	)
+	if cfg.Registry != nil {
+		reg, gatherer = cfg.Registry, cfg.Registry
+	}
+
+	o := metricOptions{registerer: reg}
+	for _, c := range []prometheus.Collector{
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+	} {
+		if _, err := register("standard collectors", c, o); err != nil {
+			return nil, err
+		}
+	}
+	if err := registerBuildInfo(reg, cfg.Namespace); err != nil {
+		return nil, err
+	}
+
+	handler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorLog:            errorLogger{},
+		ErrorHandling:       cfg.ErrorHandling,
+		Registry:            reg,
+		DisableCompression:  cfg.DisableCompression,
+		MaxRequestsInFlight: cfg.MaxRequestsInFlight,
+		Timeout:             cfg.Timeout,
+		EnableOpenMetrics:   true,
+	})
+	return promhttp.InstrumentMetricHandler(reg, handler), nil
+}
+
+// registerBuildInfo exports build_info with the module path and version,
+// the VCS revision and the Go version of the running binary.
+func registerBuildInfo(reg prometheus.Registerer, namespace string) error {
+	labels := []string{"path", "version", "revision", "modified", "goversion"}
+	buildInfo, err := NewGaugeVec("build_info", "A metric with a constant '1' value labeled by the build information of the binary.", labels, WithRegisterer(reg), WithNamespace(namespace))
+	if err != nil {
+		return err
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		buildInfo.WithLabelValues("unknown", "unknown", "unknown", "unknown", "unknown").Set(1)
+		return nil
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	buildInfo.WithLabelValues(info.Main.Path, info.Main.Version, revision, modified, info.GoVersion).Set(1)
+	return nil
+}
+
+type errorLogger struct{}
+
+func (errorLogger) Println(v ...interface{}) {
+	log.Error(fmt.Sprint(v...))
+}
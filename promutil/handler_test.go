@@ -0,0 +1,38 @@
+package promutil
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMetricsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	handler, err := NewMetricsHandler(MetricsHandlerConfig{Registry: reg, Namespace: "app"})
+	assert.NoError(err)
+	// collectors registered twice are reused
+	_, err = NewMetricsHandler(MetricsHandlerConfig{Registry: reg, Namespace: "app"})
+	assert.NoError(err)
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Contains(resp.Header.Get("Content-Type"), "application/openmetrics-text")
+	assert.Contains(string(body), "app_build_info{")
+	assert.Contains(string(body), "go_goroutines")
+	assert.Contains(string(body), "promhttp_metric_handler_requests_total")
+	assert.Contains(string(body), "# EOF")
+}
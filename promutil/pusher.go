@@ -0,0 +1,117 @@
+package promutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rosenlo/toolkits/log"
+)
+
+const (
+	DefaultPushInterval  = 15 * time.Second
+	DefaultPushBatchSize = 1000
+	DefaultPushTimeout   = 10 * time.Second
+)
+
+var (
+	pushDuration *prometheus.HistogramVec
+	pushErrors   *prometheus.CounterVec
+)
+
+func init() {
+	pushDuration, _ = NewHistogramVec("promutil_push_duration_seconds", "Duration of gathering and remote-writing a registry.", nil, []string{"job"})
+	pushErrors, _ = NewErrorCounterVec("promutil_push", "Failed registry pushes.", []string{"job"})
+}
+
+type PusherConfig struct {
+	Job      string
+	Instance string
+	// Interval between pushes, defaults to DefaultPushInterval.
+	Interval time.Duration
+	// BatchSize is the number of series per remote write request.
+	BatchSize int
+	// Timeout bounds a single push, including the final one on shutdown.
+	Timeout time.Duration
+}
+
+// Pusher periodically gathers a registry and remote-writes it.
+type Pusher struct {
+	client   *Client
+	gatherer prometheus.Gatherer
+	cfg      PusherConfig
+}
+
+// NewPusher returns a Pusher for g. A nil g pushes
+// prometheus.DefaultGatherer.
+func NewPusher(client *Client, g prometheus.Gatherer, cfg PusherConfig) *Pusher {
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultPushInterval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultPushBatchSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultPushTimeout
+	}
+	return &Pusher{
+		client:   client,
+		gatherer: g,
+		cfg:      cfg,
+	}
+}
+
+// Run pushes every Interval until ctx is cancelled, then pushes one last
+// time so the final values are not lost.
+func (p *Pusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+			if err := p.Push(flushCtx); err != nil {
+				log.Errorf("[%s] final push failed: %v", p.cfg.Job, err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			pushCtx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+			if err := p.Push(pushCtx); err != nil {
+				log.Warnf("[%s] push failed: %v", p.cfg.Job, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Push gathers and remote-writes the registry once. What could be
+// gathered is written even if gathering failed; both errors are returned
+// joined.
+func (p *Pusher) Push(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		pushDuration.WithLabelValues(p.cfg.Job).Observe(time.Since(start).Seconds())
+	}()
+
+	req, gatherErr := GatherWriteRequest(p.gatherer, p.cfg.Job, p.cfg.Instance)
+	if gatherErr != nil {
+		gatherErr = fmt.Errorf("failed to gather: %w", gatherErr)
+	}
+	var writeErr error
+	if len(req.Timeseries) > 0 {
+		writeErr = BatchRemoteWrite(ctx, p.client, req, p.cfg.BatchSize)
+	}
+
+	err := errors.Join(gatherErr, writeErr)
+	if err != nil {
+		pushErrors.WithLabelValues(p.cfg.Job).Inc()
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package promutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPusher(job string, handler http.Handler) (*Pusher, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_pushed", Help: "test"})
+	gauge.Set(1)
+	reg.MustRegister(gauge)
+	return NewPusher(NewClient(Config{InsertAddress: srv.URL}), reg, PusherConfig{Job: job, Interval: 10 * time.Millisecond}), srv
+}
+
+func TestPusherRun(t *testing.T) {
+	assert := assert.New(t)
+
+	var pushes atomic.Int64
+	sink := NewMemorySink()
+	receiver := NewReceiver(sink)
+	p, srv := newTestPusher("run", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes.Add(1)
+		receiver.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(func() bool { return pushes.Load() >= 3 }, time.Second, time.Millisecond)
+
+	cancel()
+	<-done
+	series := sink.Find("test_pushed")
+	assert.GreaterOrEqual(len(series), 3)
+	assert.Contains(series[0].Labels, prompb.Label{Name: "job", Value: "run"})
+}
+
+func TestPusherFinalPush(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := NewMemorySink()
+	p, srv := newTestPusher("final", NewReceiver(sink))
+	defer srv.Close()
+	p.cfg.Interval = time.Hour
+
+	// the final push uses a fresh context, so it succeeds after ctx is
+	// cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Run(ctx)
+	assert.Len(sink.Find("test_pushed"), 1)
+}
+
+func TestPusherErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	p, srv := newTestPusher("errors", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	failed := func() float64 { return testutil.ToFloat64(pushErrors.WithLabelValues("errors")) }
+
+	before := failed()
+	assert.Error(p.Push(context.Background()))
+	assert.Equal(before+1, failed())
+
+	// a failed gather is counted too
+	errGather := errors.New("gather failed")
+	p.gatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errGather
+	})
+	assert.ErrorIs(p.Push(context.Background()), errGather)
+	assert.Equal(before+2, failed())
+}
@@ -0,0 +1,257 @@
+package querycache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rosenlo/toolkits/lra"
+	"github.com/rosenlo/toolkits/promutil"
+)
+
+const (
+	DefaultTTL            = 30 * time.Second
+	DefaultRangeTTL       = time.Hour
+	DefaultBucketPoints   = 120
+	DefaultFreshnessDelay = 2 * time.Minute
+	DefaultMaxBytes       = 64 << 20
+
+	typeQuery      = "query"
+	typeQueryRange = "query_range"
+)
+
+var (
+	cacheHits   *prometheus.CounterVec
+	cacheMisses *prometheus.CounterVec
+)
+
+func init() {
+	cacheHits, _ = promutil.NewCounterVec("promutil_query_cache_hits_total", "Query cache hits.", []string{"type"})
+	cacheMisses, _ = promutil.NewCounterVec("promutil_query_cache_misses_total", "Query cache misses.", []string{"type"})
+}
+
+type Options struct {
+	// TTL of cached instant query results.
+	TTL time.Duration
+	// RangeTTL of cached range query buckets that lie entirely in the past.
+	RangeTTL time.Duration
+	// BucketPoints is the number of steps per cached range bucket.
+	BucketPoints int
+	// FreshnessDelay is how far behind now a bucket must end before it is
+	// considered complete and cached; more recent buckets are always
+	// fetched.
+	FreshnessDelay time.Duration
+	// MaxBytes bounds the approximate size of the cache.
+	MaxBytes int64
+}
+
+// Client caches Query and QueryRange results of a promutil.Client.
+type Client struct {
+	client *promutil.Client
+	cache  *lra.Cache
+	opts   Options
+}
+
+func New(client *promutil.Client, opts Options) *Client {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultTTL
+	}
+	if opts.RangeTTL <= 0 {
+		opts.RangeTTL = DefaultRangeTTL
+	}
+	if opts.BucketPoints <= 0 {
+		opts.BucketPoints = DefaultBucketPoints
+	}
+	if opts.FreshnessDelay <= 0 {
+		opts.FreshnessDelay = DefaultFreshnessDelay
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	return &Client{
+		client: client,
+		cache:  lra.NewWithTimeout(opts.MaxBytes, max(opts.TTL, opts.RangeTTL), nil),
+		opts:   opts,
+	}
+}
+
+// Close stops the background eviction of the cache.
+func (c *Client) Close() {
+	c.cache.Stop()
+}
+
+// Query returns the cached result of the instant query at ts if it is
+// younger than TTL. A zero ts means "now". The returned response is shared
+// with the cache and must not be modified.
+func (c *Client) Query(ctx context.Context, query string, ts time.Time) (*promutil.QueryResponse, error) {
+	key := fmt.Sprintf("%s|%s|%d", typeQuery, queryKey(ctx, query), ts.UnixMilli())
+	if ts.IsZero() {
+		key = fmt.Sprintf("%s|%s|now", typeQuery, queryKey(ctx, query))
+	}
+	if resp, ok := c.get(key); ok {
+		cacheHits.WithLabelValues(typeQuery).Inc()
+		return resp, nil
+	}
+	cacheMisses.WithLabelValues(typeQuery).Inc()
+
+	resp, err := c.client.QueryWithContext(ctx, query, ts, "")
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Add(key, newEntry(resp, c.opts.TTL))
+	return resp, nil
+}
+
+// QueryRange splits [start, end] into buckets of BucketPoints steps and
+// serves complete buckets from the cache, only querying missing buckets
+// and the fresh tail. Ranges whose start is not aligned to step are not
+// cached, since their evaluation timestamps never match a bucket.
+func (c *Client) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) (*promutil.QueryRangeResponse, error) {
+	if step < time.Millisecond {
+		return nil, fmt.Errorf("step must be at least 1ms")
+	}
+	stepStr := strconv.FormatFloat(step.Seconds(), 'f', -1, 64)
+	if start.UnixMilli()%step.Milliseconds() != 0 {
+		cacheMisses.WithLabelValues(typeQueryRange).Inc()
+		return c.client.QueryRangeWithContext(ctx, query, start, end, stepStr)
+	}
+
+	norm := queryKey(ctx, query)
+	bucket := time.Duration(c.opts.BucketPoints) * step
+	complete := time.Now().Add(-c.opts.FreshnessDelay)
+
+	var responses []*promutil.QueryRangeResponse
+	for bs := alignStart(start, bucket); !bs.After(end); bs = bs.Add(bucket) {
+		be := bs.Add(bucket - step)
+		if be.Before(complete) {
+			key := fmt.Sprintf("%s|%s|%d|%d", typeQueryRange, norm, bs.UnixMilli(), step.Milliseconds())
+			if resp, ok := c.get(key); ok {
+				cacheHits.WithLabelValues(typeQueryRange).Inc()
+				responses = append(responses, (*promutil.QueryRangeResponse)(resp))
+				continue
+			}
+			cacheMisses.WithLabelValues(typeQueryRange).Inc()
+			resp, err := c.client.QueryRangeWithContext(ctx, query, bs, be, stepStr)
+			if err != nil {
+				return nil, err
+			}
+			c.cache.Add(key, newEntry((*promutil.QueryResponse)(resp), c.opts.RangeTTL))
+			responses = append(responses, resp)
+			continue
+		}
+
+		// the tail is never cached, and only fetched up to end
+		cacheMisses.WithLabelValues(typeQueryRange).Inc()
+		if be.After(end) {
+			be = end
+		}
+		resp, err := c.client.QueryRangeWithContext(ctx, query, bs, be, stepStr)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, resp)
+	}
+
+	merged := promutil.MergeRangeResponses(responses)
+	trim(merged, start, end)
+	return merged, nil
+}
+
+func (c *Client) get(key string) (*promutil.QueryResponse, bool) {
+	value, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		return nil, false
+	}
+	return e.resp, true
+}
+
+// alignStart returns the start of the bucket containing t. Buckets are
+// aligned on the Unix epoch rather than Go's zero time, so their evaluation
+// timestamps stay multiples of the step like the requested range's.
+func alignStart(t time.Time, bucket time.Duration) time.Time {
+	ms := t.UnixMilli()
+	return time.UnixMilli(ms - ms%bucket.Milliseconds())
+}
+
+// trim drops points outside [start, end] and series left without points.
+func trim(resp *promutil.QueryRangeResponse, start, end time.Time) {
+	matrix := resp.Data.Matrix[:0]
+	for _, series := range resp.Data.Matrix {
+		values := series.Values[:0]
+		for _, p := range series.Values {
+			if !p.Timestamp.Before(start) && !p.Timestamp.After(end) {
+				values = append(values, p)
+			}
+		}
+		if len(values) > 0 {
+			series.Values = values
+			matrix = append(matrix, series)
+		}
+	}
+	resp.Data.Matrix = matrix
+}
+
+// queryKey is the normalized query, prefixed with the tenant set by
+// promutil.WithTenant so tenants never share cached results.
+func queryKey(ctx context.Context, query string) string {
+	if tenant, ok := promutil.TenantFromContext(ctx); ok {
+		return tenant.String() + "|" + normalize(query)
+	}
+	return normalize(query)
+}
+
+// normalize formats query with the PromQL printer so that equivalent
+// queries share a cache key. Queries the parser doesn't understand, like
+// MetricsQL extensions, are only trimmed.
+func normalize(query string) string {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return strings.TrimSpace(query)
+	}
+	return expr.String()
+}
+
+type entry struct {
+	resp      *promutil.QueryResponse
+	expiresAt time.Time
+	size      int
+}
+
+func newEntry(resp *promutil.QueryResponse, ttl time.Duration) *entry {
+	return &entry{resp: resp, expiresAt: time.Now().Add(ttl), size: responseSize(resp)}
+}
+
+func (e *entry) Len() int {
+	return e.size
+}
+
+// responseSize estimates the memory held by resp.
+func responseSize(resp *promutil.QueryResponse) int {
+	const pointSize = 32
+	size := 0
+	labels := func(metric map[string]string) {
+		for k, v := range metric {
+			size += len(k) + len(v)
+		}
+	}
+	for _, s := range resp.Data.Vector {
+		labels(s.Metric)
+		size += pointSize
+	}
+	for _, s := range resp.Data.Matrix {
+		labels(s.Metric)
+		size += pointSize * len(s.Values)
+	}
+	if resp.Data.String != nil {
+		size += len(resp.Data.String.Value)
+	}
+	return size + pointSize
+}
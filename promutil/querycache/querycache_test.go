@@ -0,0 +1,115 @@
+package querycache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rosenlo/toolkits/promutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(calls *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		q := r.URL.Query()
+		if r.URL.Path == promutil.V1Query {
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]}]}}`))
+			return
+		}
+		start, _ := strconv.ParseFloat(q.Get("start"), 64)
+		end, _ := strconv.ParseFloat(q.Get("end"), 64)
+		step, _ := strconv.ParseFloat(q.Get("step"), 64)
+		var values []promutil.Point
+		for ts := start; ts <= end; ts += step {
+			values = append(values, promutil.Point{Timestamp: time.Unix(int64(ts), 0), Value: ts})
+		}
+		json.NewEncoder(w).Encode(promutil.QueryRangeResponse{
+			Status: promutil.StatusSuccess,
+			Data: promutil.QueryData{ResultType: promutil.ValueTypeMatrix, Matrix: promutil.RangeVector{
+				{Metric: map[string]string{"__name__": "up"}, Values: values},
+			}},
+		})
+	}))
+}
+
+func TestQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+	srv := newServer(&calls)
+	defer srv.Close()
+
+	c := New(promutil.NewClient(promutil.Config{Address: srv.URL}), Options{})
+	defer c.Close()
+	for _, q := range []string{`sum(rate(x[5m]))`, `sum( rate(x[5m]) )`, `sum(rate(x[5m]))`} {
+		resp, err := c.Query(context.Background(), q, time.Time{})
+		assert.NoError(err)
+		assert.Len(resp.Data.Vector, 1)
+	}
+	assert.Equal(int64(1), calls.Load())
+}
+
+func TestQueryRangeReusesBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+	srv := newServer(&calls)
+	defer srv.Close()
+
+	c := New(promutil.NewClient(promutil.Config{Address: srv.URL}), Options{BucketPoints: 60})
+	defer c.Close()
+	ctx := context.Background()
+	end := time.Now().Truncate(time.Minute)
+	start := end.Add(-6 * time.Hour)
+
+	resp, err := c.QueryRange(ctx, "up", start, end, time.Minute)
+	assert.NoError(err)
+	values := resp.Data.Matrix[0].Values
+	assert.Len(values, 361)
+	assert.Equal(start, values[0].Timestamp)
+	assert.Equal(end, values[len(values)-1].Timestamp)
+	first := calls.Load()
+
+	// only the fresh tail is queried again
+	calls.Store(0)
+	resp, err = c.QueryRange(ctx, "up", start, end, time.Minute)
+	assert.NoError(err)
+	assert.Len(resp.Data.Matrix[0].Values, 361)
+	assert.Less(calls.Load(), first)
+	assert.LessOrEqual(calls.Load(), int64(2))
+}
+
+func TestQueryRangeOddStep(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+	srv := newServer(&calls)
+	defer srv.Close()
+
+	c := New(promutil.NewClient(promutil.Config{Address: srv.URL}), Options{BucketPoints: 60})
+	defer c.Close()
+	step := 7 * time.Second
+	end := time.Unix(time.Now().Add(-time.Hour).Unix()/7*7, 0)
+	start := end.Add(-1000 * step)
+
+	for _, step := range []time.Duration{0, time.Microsecond} {
+		_, err := c.QueryRange(context.Background(), "up", start, end, step)
+		assert.Error(err, step)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.QueryRange(context.Background(), "up", start, end, step)
+		assert.NoError(err)
+		values := resp.Data.Matrix[0].Values
+		assert.Len(values, 1001)
+		for _, p := range values {
+			assert.Zero(p.Timestamp.Unix()%7, p.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package promutil
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rosenlo/toolkits/log"
+)
+
+const (
+	DefaultQueueShards            = 1
+	DefaultQueueCapacity          = 10000
+	DefaultQueueMaxSamplesPerSend = 2000
+	DefaultQueueBatchSendDeadline = 5 * time.Second
+	DefaultQueueMinBackoff        = 30 * time.Millisecond
+	DefaultQueueMaxBackoff        = 5 * time.Second
+	DefaultQueueFlushDeadline     = time.Minute
+)
+
+var (
+	queueSamplesSent    *prometheus.CounterVec
+	queueSamplesFailed  *prometheus.CounterVec
+	queueSamplesRetried *prometheus.CounterVec
+	queueSamplesPending *prometheus.GaugeVec
+)
+
+func init() {
+	queueSamplesSent, _ = NewCounterVec("promutil_remote_write_samples_sent_total", "Samples successfully sent to remote storage.", []string{"queue"})
+	queueSamplesFailed, _ = NewCounterVec("promutil_remote_write_samples_failed_total", "Samples dropped after a non-recoverable error or exhausted retries.", []string{"queue"})
+	queueSamplesRetried, _ = NewCounterVec("promutil_remote_write_samples_retried_total", "Samples resent after a recoverable error.", []string{"queue"})
+	queueSamplesPending, _ = NewGaugeVec("promutil_remote_write_samples_pending", "Samples queued but not yet sent.", []string{"queue"})
+}
+
+var ErrQueueStopped = errors.New("remote write queue stopped")
+
+type QueueConfig struct {
+	// Name is used as the queue label of the self-instrumentation metrics.
+	// Defaults to the client's insert address.
+	Name string
+	// Shards is the number of concurrent senders. Series are assigned to a
+	// shard by label hash so samples of one series stay ordered.
+	Shards int
+	// Capacity is the number of series buffered per shard before Append
+	// blocks.
+	Capacity int
+	// MaxSamplesPerSend is the number of samples, histograms included, at
+	// which a batch is sent. A single series with more samples is sent on
+	// its own.
+	MaxSamplesPerSend int
+	// BatchSendDeadline is the maximum time a partial batch waits before
+	// being sent.
+	BatchSendDeadline time.Duration
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	// MaxRetries limits retries of recoverable errors, 0 retries until the
+	// queue is stopped.
+	MaxRetries int
+	// FlushDeadline bounds how long Stop waits for pending samples.
+	FlushDeadline time.Duration
+}
+
+func (cfg *QueueConfig) setDefaults() {
+	if cfg.Shards <= 0 {
+		cfg.Shards = DefaultQueueShards
+	}
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = DefaultQueueCapacity
+	}
+	if cfg.MaxSamplesPerSend <= 0 {
+		cfg.MaxSamplesPerSend = DefaultQueueMaxSamplesPerSend
+	}
+	if cfg.BatchSendDeadline <= 0 {
+		cfg.BatchSendDeadline = DefaultQueueBatchSendDeadline
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultQueueMinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultQueueMaxBackoff
+	}
+	if cfg.FlushDeadline <= 0 {
+		cfg.FlushDeadline = DefaultQueueFlushDeadline
+	}
+}
+
+// QueueManager buffers series and remote-writes them through a set of
+// shards, retrying 429 and 5xx responses with exponential backoff and
+// dropping batches rejected with other 4xx statuses.
+type QueueManager struct {
+	client *Client
+	cfg    QueueConfig
+
+	// mu guards closing the shards: Append holds the read lock while
+	// sending, Stop closes stop first so blocked senders give up before it
+	// takes the write lock.
+	mu       sync.RWMutex
+	stopped  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	shards   []chan prompb.TimeSeries
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	sent    prometheus.Counter
+	failed  prometheus.Counter
+	retried prometheus.Counter
+	pending prometheus.Gauge
+}
+
+func NewQueueManager(client *Client, cfg QueueConfig) *QueueManager {
+	cfg.setDefaults()
+	if len(cfg.Name) == 0 {
+		cfg.Name = client.GetInsertAddress()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &QueueManager{
+		client:  client,
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		shards:  make([]chan prompb.TimeSeries, cfg.Shards),
+		ctx:     ctx,
+		cancel:  cancel,
+		sent:    queueSamplesSent.WithLabelValues(cfg.Name),
+		failed:  queueSamplesFailed.WithLabelValues(cfg.Name),
+		retried: queueSamplesRetried.WithLabelValues(cfg.Name),
+		pending: queueSamplesPending.WithLabelValues(cfg.Name),
+	}
+	for i := range q.shards {
+		q.shards[i] = make(chan prompb.TimeSeries, cfg.Capacity)
+	}
+	return q
+}
+
+func (q *QueueManager) Start() {
+	for i := range q.shards {
+		q.wg.Add(1)
+		go q.runShard(q.shards[i])
+	}
+}
+
+// Append enqueues series, blocking while the target shard is full. It
+// returns ErrQueueStopped once Stop has been called, also while blocked;
+// series enqueued before that are still flushed.
+func (q *QueueManager) Append(series ...prompb.TimeSeries) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	for i := range series {
+		select {
+		case q.shards[shardOf(series[i].Labels, len(q.shards))] <- series[i]:
+			q.pending.Add(float64(sampleCount(series[i])))
+		case <-q.stop:
+			return ErrQueueStopped
+		}
+	}
+	return nil
+}
+
+func (q *QueueManager) AppendWriteRequest(req *prompb.WriteRequest) error {
+	return q.Append(req.Timeseries...)
+}
+
+// Stop stops accepting series and flushes what is buffered, giving up
+// after FlushDeadline.
+func (q *QueueManager) Stop() {
+	q.stopOnce.Do(q.stopAndFlush)
+}
+
+func (q *QueueManager) stopAndFlush() {
+	close(q.stop)
+	q.mu.Lock()
+	q.stopped = true
+	for i := range q.shards {
+		close(q.shards[i])
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(q.cfg.FlushDeadline)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Warnf("[%s] remote write queue flush deadline exceeded", q.cfg.Name)
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+}
+
+func (q *QueueManager) runShard(ch chan prompb.TimeSeries) {
+	defer q.wg.Done()
+
+	var (
+		batch   []prompb.TimeSeries
+		samples int
+	)
+	timer := time.NewTimer(q.cfg.BatchSendDeadline)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		q.send(batch, samples)
+		batch = batch[:0]
+		samples = 0
+	}
+
+	for {
+		select {
+		case ts, ok := <-ch:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ts)
+			samples += sampleCount(ts)
+			if samples >= q.cfg.MaxSamplesPerSend {
+				flush()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(q.cfg.BatchSendDeadline)
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(q.cfg.BatchSendDeadline)
+		}
+	}
+}
+
+func (q *QueueManager) send(batch []prompb.TimeSeries, samples int) {
+	defer q.pending.Sub(float64(samples))
+
+	req := &prompb.WriteRequest{Timeseries: batch}
+	backoff := q.cfg.MinBackoff
+	for try := 0; ; try++ {
+		err := q.client.Send(q.ctx, req)
+		if err == nil {
+			q.sent.Add(float64(samples))
+			return
+		}
+
+		if !recoverable(err) {
+			log.Errorf("[%s] dropping %d samples: %v", q.cfg.Name, samples, err)
+			q.failed.Add(float64(samples))
+			return
+		}
+		if q.cfg.MaxRetries > 0 && try >= q.cfg.MaxRetries {
+			log.Errorf("[%s] dropping %d samples after %d retries: %v", q.cfg.Name, samples, try, err)
+			q.failed.Add(float64(samples))
+			return
+		}
+
+		sleep := backoff
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			sleep = apiErr.RetryAfter
+		}
+		log.Warnf("[%s] failed to send batch, retrying in %v: %v", q.cfg.Name, sleep, err)
+
+		select {
+		case <-time.After(sleep):
+		case <-q.ctx.Done():
+			q.failed.Add(float64(samples))
+			return
+		}
+		q.retried.Add(float64(samples))
+
+		backoff *= 2
+		if backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
+
+func sampleCount(ts prompb.TimeSeries) int {
+	return len(ts.Samples) + len(ts.Histograms)
+}
+
+func shardOf(labels []prompb.Label, shards int) int {
+	h := fnv.New64a()
+	for _, l := range labels {
+		h.Write([]byte(l.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0xff})
+	}
+	return int(h.Sum64() % uint64(shards))
+}
@@ -0,0 +1,154 @@
+package promutil
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueManagerRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls, received atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		assert.NoError(err)
+		var req prompb.WriteRequest
+		assert.NoError(proto.Unmarshal(data, &req))
+		received.Add(int64(len(req.Timeseries)))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	q := NewQueueManager(NewClient(Config{InsertAddress: srv.URL}), QueueConfig{
+		Name:              "retry",
+		Shards:            2,
+		BatchSendDeadline: 10 * time.Millisecond,
+		MinBackoff:        time.Millisecond,
+	})
+	q.Start()
+	for i := 0; i < 10; i++ {
+		assert.NoError(q.Append(prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "i", Value: string(rune('a' + i))}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: time.Now().UnixMilli()}},
+		}))
+	}
+	q.Stop()
+
+	assert.Equal(int64(10), received.Load())
+	assert.ErrorIs(q.Append(prompb.TimeSeries{}), ErrQueueStopped)
+}
+
+func TestQueueManagerDropOn4xx(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	q := NewQueueManager(NewClient(Config{InsertAddress: srv.URL}), QueueConfig{Name: "drop"})
+	q.Start()
+	assert.NoError(q.Append(prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1}},
+	}))
+	q.Stop()
+
+	assert.Equal(int64(1), calls.Load())
+}
+
+func TestQueueManagerStopWhileBlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	q := NewQueueManager(NewClient(Config{InsertAddress: srv.URL}), QueueConfig{
+		Name:              "blocked",
+		Capacity:          1,
+		MaxSamplesPerSend: 1,
+		BatchSendDeadline: time.Millisecond,
+		MinBackoff:        time.Millisecond,
+		MaxBackoff:        10 * time.Millisecond,
+		FlushDeadline:     100 * time.Millisecond,
+	})
+	q.Start()
+
+	// the shard retries forever and the queue fills up, so Append blocks
+	appendErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			err := q.Append(prompb.TimeSeries{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+				Samples: []prompb.Sample{{Value: float64(i)}},
+			})
+			if err != nil {
+				appendErr <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return after the flush deadline")
+	}
+	assert.ErrorIs(<-appendErr, ErrQueueStopped)
+}
+
+func TestQueueManagerBatchesBySamples(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	q := NewQueueManager(NewClient(Config{InsertAddress: srv.URL}), QueueConfig{
+		Name:              "samples",
+		MaxSamplesPerSend: 10,
+		BatchSendDeadline: time.Minute,
+	})
+	q.Start()
+	for i := 0; i < 4; i++ {
+		assert.NoError(q.Append(prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: make([]prompb.Sample, 5),
+		}))
+	}
+	assert.Eventually(func() bool { return requests.Load() == 2 }, time.Second, time.Millisecond)
+	q.Stop()
+	assert.Equal(int64(2), requests.Load())
+}
@@ -0,0 +1,334 @@
+package promutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/rosenlo/toolkits/log"
+)
+
+// DefaultReceiverMaxBytes bounds request bodies and decompressed remote
+// write payloads.
+const DefaultReceiverMaxBytes = 32 << 20
+
+var (
+	// errTooLarge is returned by decodeRemoteWrite for payloads
+	// decompressing beyond the limit.
+	errTooLarge = errors.New("request too large")
+	// errUnsupportedEncoding is returned by decodeRemoteWrite for a
+	// Content-Encoding other than snappy or zstd.
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// Sink receives the series decoded by a Receiver.
+type Sink interface {
+	Append(ctx context.Context, series []prompb.TimeSeries) error
+}
+
+// Receiver is an http.Handler accepting remote write requests (1.0 and
+// 2.0, snappy or zstd encoded) and the text exposition sent by
+// Client.Import. Mount it on V1Write and V1Import.
+type Receiver struct {
+	sink     Sink
+	maxBytes int64
+}
+
+type ReceiverOption func(*Receiver)
+
+// WithMaxBytes bounds the size of request bodies and of decompressed
+// remote write payloads, DefaultReceiverMaxBytes by default. Larger
+// requests are rejected with 413 Request Entity Too Large.
+func WithMaxBytes(n int64) ReceiverOption {
+	return func(rv *Receiver) {
+		rv.maxBytes = n
+	}
+}
+
+func NewReceiver(sink Sink, opts ...ReceiverOption) *Receiver {
+	rv := &Receiver{sink: sink, maxBytes: DefaultReceiverMaxBytes}
+	for _, fn := range opts {
+		fn(rv)
+	}
+	return rv
+}
+
+func (rv *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, rv.maxBytes))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("request body exceeds %d bytes", rv.maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var series []prompb.TimeSeries
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-protobuf") {
+		series, err = decodeRemoteWrite(r.Header, body, rv.maxBytes)
+	} else {
+		series, err = decodeTextExposition(body)
+	}
+	if errors.Is(err, errTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for i := range series {
+		if err := validateLabels(series[i].Labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := rv.sink.Append(r.Context(), series); err != nil {
+		log.Errorf("failed to append %d series: %v", len(series), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isRemoteWriteV2(r.Header) {
+		// 2.0 senders check these to detect partial writes
+		var samples, histograms int
+		for _, ts := range series {
+			samples += len(ts.Samples)
+			histograms += len(ts.Histograms)
+		}
+		w.Header().Set(RemoteWriteSamplesWrittenHeader, strconv.Itoa(samples))
+		w.Header().Set(RemoteWriteHistogramsWrittenHeader, strconv.Itoa(histograms))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isRemoteWriteV2(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/x-protobuf") &&
+		strings.Contains(header.Get("Content-Type"), "io.prometheus.write.v2.Request")
+}
+
+func decodeRemoteWrite(header http.Header, body []byte, maxBytes int64) ([]prompb.TimeSeries, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch encoding := header.Get("Content-Encoding"); encoding {
+	case CompressionZstd:
+		var dec *zstd.Decoder
+		dec, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxBytes)))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		data, err = dec.DecodeAll(body, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			err = errTooLarge
+		}
+	case CompressionSnappy, "":
+		var n int
+		if n, err = snappy.DecodedLen(body); err == nil && int64(n) > maxBytes {
+			err = errTooLarge
+		} else if err == nil {
+			data, err = snappy.Decode(nil, body)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+	if errors.Is(err, errTooLarge) {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes: %w", maxBytes, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	if isRemoteWriteV2(header) {
+		var req writev2.Request
+		if err := req.Unmarshal(data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal: %w", err)
+		}
+		return fromWriteRequestV2(&req)
+	}
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	return req.Timeseries, nil
+}
+
+func fromWriteRequestV2(req *writev2.Request) ([]prompb.TimeSeries, error) {
+	series := make([]prompb.TimeSeries, 0, len(req.Timeseries))
+	for _, ts := range req.Timeseries {
+		if len(ts.LabelsRefs)%2 != 0 {
+			return nil, fmt.Errorf("odd number of label refs")
+		}
+		result := prompb.TimeSeries{Labels: make([]prompb.Label, 0, len(ts.LabelsRefs)/2)}
+		for i := 0; i < len(ts.LabelsRefs); i += 2 {
+			name, value := ts.LabelsRefs[i], ts.LabelsRefs[i+1]
+			if int(name) >= len(req.Symbols) || int(value) >= len(req.Symbols) {
+				return nil, fmt.Errorf("label ref out of range")
+			}
+			result.Labels = append(result.Labels, prompb.Label{Name: req.Symbols[name], Value: req.Symbols[value]})
+		}
+		for _, s := range ts.Samples {
+			result.Samples = append(result.Samples, prompb.Sample{Value: s.Value, Timestamp: s.Timestamp})
+		}
+		for _, h := range ts.Histograms {
+			result.Histograms = append(result.Histograms, fromHistogramV2(h))
+		}
+		series = append(series, result)
+	}
+	return series, nil
+}
+
+func fromHistogramV2(h writev2.Histogram) prompb.Histogram {
+	result := prompb.Histogram{
+		Sum:            h.Sum,
+		Schema:         h.Schema,
+		ZeroThreshold:  h.ZeroThreshold,
+		NegativeDeltas: h.NegativeDeltas,
+		NegativeCounts: h.NegativeCounts,
+		PositiveDeltas: h.PositiveDeltas,
+		PositiveCounts: h.PositiveCounts,
+		ResetHint:      prompb.Histogram_ResetHint(h.ResetHint),
+		Timestamp:      h.Timestamp,
+	}
+	switch count := h.Count.(type) {
+	case *writev2.Histogram_CountInt:
+		result.Count = &prompb.Histogram_CountInt{CountInt: count.CountInt}
+	case *writev2.Histogram_CountFloat:
+		result.Count = &prompb.Histogram_CountFloat{CountFloat: count.CountFloat}
+	}
+	switch count := h.ZeroCount.(type) {
+	case *writev2.Histogram_ZeroCountInt:
+		result.ZeroCount = &prompb.Histogram_ZeroCountInt{ZeroCountInt: count.ZeroCountInt}
+	case *writev2.Histogram_ZeroCountFloat:
+		result.ZeroCount = &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: count.ZeroCountFloat}
+	}
+	for _, span := range h.NegativeSpans {
+		result.NegativeSpans = append(result.NegativeSpans, prompb.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+	for _, span := range h.PositiveSpans {
+		result.PositiveSpans = append(result.PositiveSpans, prompb.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+	return result
+}
+
+func decodeTextExposition(body []byte) ([]prompb.TimeSeries, error) {
+	text := string(body)
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text exposition: %w", err)
+	}
+
+	req := &prompb.WriteRequest{}
+	now := time.Now().UnixMilli()
+	for name, mf := range mfs {
+		for _, metric := range mf.Metric {
+			appendMetric(req, name, metric, "", "", now)
+		}
+	}
+	for i := range req.Timeseries {
+		sortLabels(req.Timeseries[i].Labels)
+	}
+	return req.Timeseries, nil
+}
+
+func validateLabels(labels []prompb.Label) error {
+	var name string
+	seen := make(map[string]struct{}, len(labels))
+	for _, l := range labels {
+		if !model.LabelName(l.Name).IsValid() {
+			return fmt.Errorf("invalid label name %q", l.Name)
+		}
+		if !utf8.ValidString(l.Value) {
+			return fmt.Errorf("invalid value of label %q", l.Name)
+		}
+		if _, ok := seen[l.Name]; ok {
+			return fmt.Errorf("duplicate label name %q", l.Name)
+		}
+		seen[l.Name] = struct{}{}
+		if l.Name == model.MetricNameLabel {
+			name = l.Value
+		}
+	}
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	return nil
+}
+
+// MemorySink keeps every received series in memory, for tests.
+type MemorySink struct {
+	mu     sync.Mutex
+	series []prompb.TimeSeries
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Append(_ context.Context, series []prompb.TimeSeries) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series = append(s.series, series...)
+	return nil
+}
+
+// Series returns a copy of the received series.
+func (s *MemorySink) Series() []prompb.TimeSeries {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]prompb.TimeSeries(nil), s.series...)
+}
+
+// Find returns the received series whose metric name is name.
+func (s *MemorySink) Find(name string) []prompb.TimeSeries {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []prompb.TimeSeries
+	for _, ts := range s.series {
+		for _, l := range ts.Labels {
+			if l.Name == model.MetricNameLabel && l.Value == name {
+				result = append(result, ts)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series = nil
+}
@@ -0,0 +1,135 @@
+package promutil
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReceiver() (*httptest.Server, *MemorySink) {
+	sink := NewMemorySink()
+	mux := http.NewServeMux()
+	mux.Handle(V1Write, NewReceiver(sink))
+	mux.Handle(V1Import, NewReceiver(sink))
+	return httptest.NewServer(mux), sink
+}
+
+func TestReceiverRemoteWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, sink := newTestReceiver()
+	defer srv.Close()
+	client := NewClient(Config{InsertAddress: srv.URL})
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "test"}, []string{"i"})
+	reg.MustRegister(gauge)
+	for _, i := range []string{"a", "b", "c"} {
+		gauge.WithLabelValues(i).Set(1)
+	}
+	req, err := GatherWriteRequest(reg, "job", "instance")
+	assert.NoError(err)
+
+	assert.NoError(BatchRemoteWrite(context.Background(), client, req, 2))
+	assert.Len(sink.Find("test_gauge"), 3)
+
+	sink.Reset()
+	v2 := NewClient(Config{InsertAddress: srv.URL}, WithRemoteWriteVersion(RemoteWriteVersion2), WithCompression(CompressionZstd))
+	assert.NoError(v2.Send(context.Background(), req))
+	assert.Equal(req.Timeseries, sink.Series())
+}
+
+func TestReceiverImport(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, sink := newTestReceiver()
+	defer srv.Close()
+	client := NewClient(Config{InsertAddress: srv.URL})
+
+	payload := MetricFormatter("test_import", "job", 1.5, 1700000000000, map[string]string{"zone": "z1"})
+	assert.NoError(client.Import(context.Background(), payload))
+
+	series := sink.Find("test_import")
+	assert.Len(series, 1)
+	assert.Equal(1.5, series[0].Samples[0].Value)
+	assert.Equal(int64(1700000000000), series[0].Samples[0].Timestamp)
+
+	err := client.Import(context.Background(), `bad-name{a="b"} 1`)
+	assert.Error(err)
+}
+
+func TestReceiverMaxBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := NewMemorySink()
+	srv := httptest.NewServer(NewReceiver(sink, WithMaxBytes(1024)))
+	defer srv.Close()
+
+	post := func(body []byte, header map[string]string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(http.StatusNoContent, post([]byte("up 1\n"), nil))
+	assert.Equal(http.StatusRequestEntityTooLarge, post(bytes.Repeat([]byte("up 1\n"), 1000), nil))
+
+	// payloads compressing below the limit are checked once decompressed
+	big := bytes.Repeat([]byte{0}, 4096)
+	header := map[string]string{"Content-Type": contentTypeV1}
+	assert.Equal(http.StatusRequestEntityTooLarge, post(snappy.Encode(nil, big), header))
+	header["Content-Encoding"] = CompressionZstd
+	assert.Equal(http.StatusRequestEntityTooLarge, post(zstdEncoder.EncodeAll(big, nil), header))
+
+	assert.Len(sink.Series(), 1)
+}
+
+func TestReceiverRemoteWriteHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(NewReceiver(NewMemorySink()))
+	defer srv.Close()
+
+	post := func(payload []byte, contentType, encoding string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a"}}, Samples: []prompb.Sample{{Value: 1}, {Value: 2, Timestamp: 1}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "b"}}, Samples: []prompb.Sample{{Value: 3}}},
+	}}
+	v2, err := ToWriteRequestV2(req).Marshal()
+	assert.NoError(err)
+	resp := post(snappy.Encode(nil, v2), contentTypeV2, CompressionSnappy)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal("3", resp.Header.Get(RemoteWriteSamplesWrittenHeader))
+	assert.Equal("0", resp.Header.Get(RemoteWriteHistogramsWrittenHeader))
+
+	// 1.0 responses carry no counts
+	v1, err := req.Marshal()
+	assert.NoError(err)
+	resp = post(snappy.Encode(nil, v1), contentTypeV1, CompressionSnappy)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Empty(resp.Header.Get(RemoteWriteSamplesWrittenHeader))
+
+	resp = post(snappy.Encode(nil, v1), contentTypeV1, "gzip")
+	assert.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+}
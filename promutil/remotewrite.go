@@ -2,11 +2,13 @@ package promutil
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
@@ -14,78 +16,223 @@ import (
 	"github.com/rosenlo/toolkits/log"
 )
 
-var (
-	fqNameRe = regexp.MustCompile(`fqName: "([^"]*)"`)
-)
+type buildOptions struct {
+	metadata  bool
+	timestamp time.Time
+}
+
+type BuildOption func(*buildOptions)
+
+// WithMetadata adds a prompb.MetricMetadata entry with HELP and TYPE for
+// every metric family.
+func WithMetadata() BuildOption {
+	return func(o *buildOptions) {
+		o.metadata = true
+	}
+}
+
+// WithTimestamp sets the timestamp used for samples that don't carry one.
+// Defaults to the time the request is built.
+func WithTimestamp(t time.Time) BuildOption {
+	return func(o *buildOptions) {
+		o.timestamp = t
+	}
+}
+
+var descRe = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*")`)
+
+func newBuildOptions(opts []BuildOption) buildOptions {
+	o := buildOptions{timestamp: time.Now()}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return o
+}
+
+// BuildWriteRequest drains ch and converts every metric into remote write
+// series. Metrics are converted as they are received, without the
+// consistency checks of a registry, so duplicate series and families with
+// differing help are kept. Metrics that fail to write are logged and
+// skipped.
+//
+// Deprecated: use GatherWriteRequest. The metric name and help are
+// scraped from Desc.String, whose format client_golang doesn't guarantee;
+// metrics whose Desc can't be parsed are dropped.
+func BuildWriteRequest(ch chan prometheus.Metric, jobName, instance string, opts ...BuildOption) *prompb.WriteRequest {
+	o := newBuildOptions(opts)
 
-func BuildWriteRequest(ch chan prometheus.Metric, jobName, instance string) *prompb.WriteRequest {
 	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{}}
-	cch := ch
-	start := time.Now()
-
-	for {
-		select {
-		case inst, ok := <-cch:
-			if !ok {
-				cch = nil
-				break
-			}
-			metric := new(dto.Metric)
-			err := inst.Write(metric)
-			if err != nil {
-				log.Warnf(err.Error())
-				continue
-			}
-
-			desc := inst.Desc().String()
-			submatch := fqNameRe.FindStringSubmatch(desc)
-			if len(submatch) <= 1 {
-				continue
-			}
-
-			var commonLabel []prompb.Label
-			fqName := submatch[1]
-			for _, l := range metric.Label {
-				commonLabel = append(commonLabel, prompb.Label{
-					Name:  l.GetName(),
-					Value: l.GetValue(),
-				})
-			}
-			commonLabel = append(commonLabel, prompb.Label{
-				Name:  model.JobLabel,
-				Value: jobName,
-			}, prompb.Label{
-				Name:  model.InstanceLabel,
-				Value: instance,
+	families := make(map[string]struct{})
+	for inst := range ch {
+		metric := new(dto.Metric)
+		if err := inst.Write(metric); err != nil {
+			log.Warnf("failed to write metric %s: %v", inst.Desc(), err)
+			continue
+		}
+		fqName, help, ok := parseDesc(inst.Desc())
+		if !ok {
+			continue
+		}
+		if _, ok := families[fqName]; !ok && o.metadata {
+			families[fqName] = struct{}{}
+			req.Metadata = append(req.Metadata, prompb.MetricMetadata{
+				Type:             metricMetadataType(metricType(metric)),
+				MetricFamilyName: fqName,
+				Help:             help,
 			})
-			timestamp := metric.GetTimestampMs()
-			if timestamp == 0 {
-				timestamp = start.UnixMilli()
-			}
-
-			if metric.Histogram != nil {
-				FillHistogram(req, metric.Histogram, commonLabel, fqName, timestamp)
-			}
-			if metric.Gauge != nil {
-				FillGauge(req, metric.Gauge, commonLabel, fqName, timestamp)
-			}
-			if metric.Counter != nil {
-				FillCounter(req, metric.Counter, commonLabel, fqName, timestamp)
-			}
+		}
+		appendMetric(req, fqName, metric, jobName, instance, o.timestamp.UnixMilli())
+	}
+	for i := range req.Timeseries {
+		sortLabels(req.Timeseries[i].Labels)
+	}
+	return req
+}
+
+// parseDesc returns the name and help of desc, which are only exposed
+// through its String method. Only the deprecated BuildWriteRequest uses it.
+func parseDesc(desc *prometheus.Desc) (string, string, bool) {
+	submatch := descRe.FindStringSubmatch(desc.String())
+	if len(submatch) != 3 {
+		return "", "", false
+	}
+	fqName, err := strconv.Unquote(submatch[1])
+	if err != nil {
+		return "", "", false
+	}
+	help, _ := strconv.Unquote(submatch[2])
+	return fqName, help, true
+}
+
+func metricType(metric *dto.Metric) dto.MetricType {
+	switch {
+	case metric.Counter != nil:
+		return dto.MetricType_COUNTER
+	case metric.Gauge != nil:
+		return dto.MetricType_GAUGE
+	case metric.Summary != nil:
+		return dto.MetricType_SUMMARY
+	case metric.Histogram != nil:
+		return dto.MetricType_HISTOGRAM
+	default:
+		return dto.MetricType_UNTYPED
+	}
+}
 
+// GatherWriteRequest gathers g and converts the metric families into a
+// WriteRequest. A nil g uses prometheus.DefaultGatherer. The job and
+// instance labels are only added when they are not empty and the metric
+// doesn't already carry them. Labels of every series are sorted by name.
+//
+// Like prometheus.Gatherer, it returns as much as it could gather
+// together with any error encountered.
+func GatherWriteRequest(g prometheus.Gatherer, jobName, instance string, opts ...BuildOption) (*prompb.WriteRequest, error) {
+	o := newBuildOptions(opts)
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{}}
+	mfs, err := g.Gather()
+	for _, mf := range mfs {
+		if o.metadata {
+			req.Metadata = append(req.Metadata, prompb.MetricMetadata{
+				Type:             metricMetadataType(mf.GetType()),
+				MetricFamilyName: mf.GetName(),
+				Help:             mf.GetHelp(),
+				Unit:             mf.GetUnit(),
+			})
 		}
+		for _, metric := range mf.Metric {
+			appendMetric(req, mf.GetName(), metric, jobName, instance, o.timestamp.UnixMilli())
+		}
+	}
+	for i := range req.Timeseries {
+		sortLabels(req.Timeseries[i].Labels)
+	}
 
-		if cch == nil {
-			break
+	return req, err
+}
+
+func appendMetric(req *prompb.WriteRequest, fqName string, metric *dto.Metric, jobName, instance string, defaultTimestamp int64) {
+	var hasJob, hasInstance bool
+	commonLabel := make([]prompb.Label, 0, len(metric.Label)+2)
+	for _, l := range metric.Label {
+		switch l.GetName() {
+		case model.JobLabel:
+			hasJob = true
+		case model.InstanceLabel:
+			hasInstance = true
 		}
+		commonLabel = append(commonLabel, prompb.Label{
+			Name:  l.GetName(),
+			Value: l.GetValue(),
+		})
+	}
+	if !hasJob && len(jobName) != 0 {
+		commonLabel = append(commonLabel, prompb.Label{
+			Name:  model.JobLabel,
+			Value: jobName,
+		})
+	}
+	if !hasInstance && len(instance) != 0 {
+		commonLabel = append(commonLabel, prompb.Label{
+			Name:  model.InstanceLabel,
+			Value: instance,
+		})
 	}
 
-	return req
+	timestamp := metric.GetTimestampMs()
+	if timestamp == 0 {
+		timestamp = defaultTimestamp
+	}
+
+	if metric.Histogram != nil {
+		if len(metric.Histogram.Bucket) > 0 || !IsNativeHistogram(metric.Histogram) {
+			FillHistogram(req, metric.Histogram, commonLabel, fqName, timestamp)
+		}
+		if IsNativeHistogram(metric.Histogram) {
+			FillNativeHistogram(req, metric.Histogram, commonLabel, fqName, timestamp)
+		}
+	}
+	if metric.Summary != nil {
+		FillSummary(req, metric.Summary, commonLabel, fqName, timestamp)
+	}
+	if metric.Gauge != nil {
+		FillGauge(req, metric.Gauge, commonLabel, fqName, timestamp)
+	}
+	if metric.Counter != nil {
+		FillCounter(req, metric.Counter, commonLabel, fqName, timestamp)
+	}
+	if metric.Untyped != nil {
+		FillUntyped(req, metric.Untyped, commonLabel, fqName, timestamp)
+	}
+}
+
+func metricMetadataType(t dto.MetricType) prompb.MetricMetadata_MetricType {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return prompb.MetricMetadata_COUNTER
+	case dto.MetricType_GAUGE:
+		return prompb.MetricMetadata_GAUGE
+	case dto.MetricType_SUMMARY:
+		return prompb.MetricMetadata_SUMMARY
+	case dto.MetricType_HISTOGRAM:
+		return prompb.MetricMetadata_HISTOGRAM
+	case dto.MetricType_GAUGE_HISTOGRAM:
+		return prompb.MetricMetadata_GAUGEHISTOGRAM
+	default:
+		return prompb.MetricMetadata_UNKNOWN
+	}
 }
 
+// BatchRemoteWrite sends req in batches of at most batch series with
+// Client.Send. A failed batch doesn't stop the remaining ones; all errors
+// are returned joined. Use QueueManager for retries.
 func BatchRemoteWrite(ctx context.Context, promClient *Client, req *prompb.WriteRequest, batch int) error {
 	ts := req.Timeseries
 
+	var errs []error
 	r := &prompb.WriteRequest{}
 	defer r.Reset()
 	for i := 0; i < len(ts); i += batch {
@@ -95,17 +242,12 @@ func BatchRemoteWrite(ctx context.Context, promClient *Client, req *prompb.Write
 			r.Timeseries = ts[i : i+batch]
 		}
 
-		data, err := proto.Marshal(r)
-		if err != nil {
-			return err
-		}
-		err = promClient.Write(ctx, data)
-		if err != nil {
-			return err
+		if err := promClient.Send(ctx, r); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func FillCounter(
@@ -202,24 +344,129 @@ func FillHistogram(
 		},
 	})
 
-	var bucketLabel []prompb.Label
-	bucketLabel = append(bucketLabel, commonLabel...)
-
+	var infSeen bool
 	for _, b := range histogram.Bucket {
-		t := prompb.TimeSeries{}
-		metricLabel := append(bucketLabel, prompb.Label{
-			Name:  model.MetricNameLabel,
-			Value: fmt.Sprintf("%s_bucket", fqName),
-		}, prompb.Label{
+		if math.IsInf(b.GetUpperBound(), 1) {
+			infSeen = true
+		}
+		appendSample(req, seriesLabels(commonLabel, fmt.Sprintf("%s_bucket", fqName), prompb.Label{
 			Name:  model.BucketLabel,
 			Value: fmt.Sprintf("%v", b.GetUpperBound()),
+		}), float64(b.GetCumulativeCount()), timestamp)
+	}
+	if !infSeen {
+		appendSample(req, seriesLabels(commonLabel, fmt.Sprintf("%s_bucket", fqName), prompb.Label{
+			Name:  model.BucketLabel,
+			Value: "+Inf",
+		}), float64(histogram.GetSampleCount()), timestamp)
+	}
+}
+
+func FillSummary(
+	req *prompb.WriteRequest,
+	summary *dto.Summary,
+	commonLabel []prompb.Label,
+	fqName string,
+	timestamp int64,
+) {
+	for _, q := range summary.Quantile {
+		appendSample(req, seriesLabels(commonLabel, fqName, prompb.Label{
+			Name:  model.QuantileLabel,
+			Value: fmt.Sprintf("%v", q.GetQuantile()),
+		}), q.GetValue(), timestamp)
+	}
+	appendSample(req, seriesLabels(commonLabel, fmt.Sprintf("%s_sum", fqName)), summary.GetSampleSum(), timestamp)
+	appendSample(req, seriesLabels(commonLabel, fmt.Sprintf("%s_count", fqName)), float64(summary.GetSampleCount()), timestamp)
+}
+
+func FillUntyped(
+	req *prompb.WriteRequest,
+	untyped *dto.Untyped,
+	commonLabel []prompb.Label,
+	fqName string,
+	timestamp int64,
+) {
+	appendSample(req, seriesLabels(commonLabel, fqName), untyped.GetValue(), timestamp)
+}
+
+// IsNativeHistogram reports whether the histogram carries sparse buckets.
+// client_golang always sets the schema for native histograms, even before
+// the first observation.
+func IsNativeHistogram(histogram *dto.Histogram) bool {
+	return histogram.Schema != nil ||
+		histogram.GetZeroThreshold() > 0 ||
+		len(histogram.PositiveSpan) > 0 ||
+		len(histogram.NegativeSpan) > 0
+}
+
+func FillNativeHistogram(
+	req *prompb.WriteRequest,
+	histogram *dto.Histogram,
+	commonLabel []prompb.Label,
+	fqName string,
+	timestamp int64,
+) {
+	h := prompb.Histogram{
+		Sum:           histogram.GetSampleSum(),
+		Schema:        histogram.GetSchema(),
+		ZeroThreshold: histogram.GetZeroThreshold(),
+		NegativeSpans: bucketSpans(histogram.NegativeSpan),
+		PositiveSpans: bucketSpans(histogram.PositiveSpan),
+		Timestamp:     timestamp,
+	}
+	if histogram.GetSampleCountFloat() > 0 {
+		h.Count = &prompb.Histogram_CountFloat{CountFloat: histogram.GetSampleCountFloat()}
+		h.ZeroCount = &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: histogram.GetZeroCountFloat()}
+		h.NegativeCounts = histogram.NegativeCount
+		h.PositiveCounts = histogram.PositiveCount
+	} else {
+		h.Count = &prompb.Histogram_CountInt{CountInt: histogram.GetSampleCount()}
+		h.ZeroCount = &prompb.Histogram_ZeroCountInt{ZeroCountInt: histogram.GetZeroCount()}
+		h.NegativeDeltas = histogram.NegativeDelta
+		h.PositiveDeltas = histogram.PositiveDelta
+	}
+
+	req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+		Labels:     seriesLabels(commonLabel, fqName),
+		Histograms: []prompb.Histogram{h},
+	})
+}
+
+func bucketSpans(spans []*dto.BucketSpan) []prompb.BucketSpan {
+	if len(spans) == 0 {
+		return nil
+	}
+	result := make([]prompb.BucketSpan, 0, len(spans))
+	for _, span := range spans {
+		result = append(result, prompb.BucketSpan{
+			Offset: span.GetOffset(),
+			Length: span.GetLength(),
 		})
-		t.Labels = metricLabel
-		sample := prompb.Sample{
-			Value:     float64(b.GetCumulativeCount()),
-			Timestamp: timestamp,
-		}
-		t.Samples = append(t.Samples, sample)
-		req.Timeseries = append(req.Timeseries, t)
 	}
+	return result
+}
+
+// seriesLabels returns a new label slice with the metric name, the common
+// labels and any extra labels, never sharing a backing array with
+// commonLabel.
+func seriesLabels(commonLabel []prompb.Label, name string, extra ...prompb.Label) []prompb.Label {
+	label := make([]prompb.Label, 0, len(commonLabel)+len(extra)+1)
+	label = append(label, prompb.Label{
+		Name:  model.MetricNameLabel,
+		Value: name,
+	})
+	label = append(label, commonLabel...)
+	return append(label, extra...)
+}
+
+func appendSample(req *prompb.WriteRequest, label []prompb.Label, value float64, timestamp int64) {
+	req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+		Labels: label,
+		Samples: []prompb.Sample{
+			{
+				Value:     value,
+				Timestamp: timestamp,
+			},
+		},
+	})
 }
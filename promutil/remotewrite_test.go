@@ -0,0 +1,136 @@
+package promutil
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func collect(c prometheus.Collector) chan prometheus.Metric {
+	ch := make(chan prometheus.Metric, 1024)
+	c.Collect(ch)
+	close(ch)
+	return ch
+}
+
+func seriesByName(req *prompb.WriteRequest) map[string][]prompb.TimeSeries {
+	result := make(map[string][]prompb.TimeSeries)
+	for _, ts := range req.Timeseries {
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				result[l.Value] = append(result[l.Value], ts)
+			}
+		}
+	}
+	return result
+}
+
+func TestBuildWriteRequestSummaryAndUntyped(t *testing.T) {
+	assert := assert.New(t)
+
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{
+		Name:       "test_summary",
+		Help:       "test",
+		Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+	})
+	summary.Observe(1)
+	summary.Observe(3)
+
+	series := seriesByName(BuildWriteRequest(collect(summary), "job", "instance"))
+	assert.Len(series["test_summary"], 2)
+	assert.Equal(4.0, series["test_summary_sum"][0].Samples[0].Value)
+	assert.Equal(2.0, series["test_summary_count"][0].Samples[0].Value)
+
+	untyped := prometheus.NewUntypedFunc(prometheus.UntypedOpts{Name: "test_untyped", Help: "test"}, func() float64 { return 42 })
+	series = seriesByName(BuildWriteRequest(collect(untyped), "job", "instance"))
+	assert.Equal(42.0, series["test_untyped"][0].Samples[0].Value)
+}
+
+func TestBuildWriteRequestHistograms(t *testing.T) {
+	assert := assert.New(t)
+
+	classic := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_classic",
+		Help:    "test",
+		Buckets: []float64{1, 2, 3, 4, 5},
+	})
+	classic.Observe(1.5)
+
+	series := seriesByName(BuildWriteRequest(collect(classic), "job", "instance"))
+	buckets := series["test_classic_bucket"]
+	assert.Len(buckets, 6)
+	les := make([]string, 0, len(buckets))
+	for _, ts := range buckets {
+		les = append(les, ts.Labels[len(ts.Labels)-1].Value)
+	}
+	assert.Equal([]string{"1", "2", "3", "4", "5", "+Inf"}, les)
+
+	native := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        "test_native",
+		Help:                        "test",
+		NativeHistogramBucketFactor: 1.1,
+	})
+	native.Observe(1.5)
+	native.Observe(-2)
+
+	series = seriesByName(BuildWriteRequest(collect(native), "job", "instance"))
+	assert.NotContains(series, "test_native_bucket")
+	assert.Len(series["test_native"], 1)
+	h := series["test_native"][0].Histograms[0]
+	assert.Equal(uint64(2), h.GetCountInt())
+	assert.Equal(-0.5, h.Sum)
+	assert.NotEmpty(h.PositiveSpans)
+	assert.NotEmpty(h.NegativeSpans)
+}
+
+func TestBuildWriteRequestUnchecked(t *testing.T) {
+	assert := assert.New(t)
+
+	// duplicate series and differing help are rejected by a registry but
+	// kept by the channel API
+	a := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_dup", Help: "first \"help\""})
+	b := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_dup", Help: "second"})
+	a.Set(1)
+	b.Set(2)
+	ch := make(chan prometheus.Metric, 2)
+	a.Collect(ch)
+	b.Collect(ch)
+	close(ch)
+
+	req := BuildWriteRequest(ch, "job", "", WithMetadata())
+	series := seriesByName(req)["test_dup"]
+	assert.Len(series, 2)
+	assert.Equal(1.0, series[0].Samples[0].Value)
+	assert.Equal(2.0, series[1].Samples[0].Value)
+	assert.Equal([]prompb.MetricMetadata{{
+		Type:             prompb.MetricMetadata_GAUGE,
+		MetricFamilyName: "test_dup",
+		Help:             `first "help"`,
+	}}, req.Metadata)
+}
+
+func TestGatherWriteRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total", Help: "requests"}, []string{"zone", "job"})
+	reg.MustRegister(counter)
+	counter.WithLabelValues("z1", "custom").Inc()
+
+	req, err := GatherWriteRequest(reg, "job", "instance", WithMetadata())
+	assert.NoError(err)
+	assert.Len(req.Timeseries, 1)
+	assert.Equal([]prompb.Label{
+		{Name: "__name__", Value: "test_requests_total"},
+		{Name: "instance", Value: "instance"},
+		{Name: "job", Value: "custom"},
+		{Name: "zone", Value: "z1"},
+	}, req.Timeseries[0].Labels)
+	assert.Equal([]prompb.MetricMetadata{{
+		Type:             prompb.MetricMetadata_COUNTER,
+		MetricFamilyName: "test_requests_total",
+		Help:             "requests",
+	}}, req.Metadata)
+}
@@ -0,0 +1,304 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/template"
+	"github.com/rosenlo/toolkits/log"
+	"github.com/rosenlo/toolkits/promutil"
+)
+
+const (
+	// resolvedRetention is how long resolved alerts are kept and resent
+	// so Alertmanager learns about the resolution.
+	resolvedRetention = 15 * time.Minute
+
+	alertMetricName = "ALERTS"
+	alertNameLabel  = "alertname"
+	alertStateLabel = "alertstate"
+
+	templateDefs = "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$externalURL := .ExternalURL}}{{$value := .Value}}"
+)
+
+type AlertState int
+
+const (
+	StateInactive AlertState = iota
+	StatePending
+	StateFiring
+)
+
+func (s AlertState) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateFiring:
+		return "firing"
+	}
+	return "inactive"
+}
+
+// Alert is one active or recently resolved instance of an alerting rule.
+type Alert struct {
+	State       AlertState
+	Labels      map[string]string
+	Annotations map[string]string
+	Value       float64
+	// GeneratorURL links to the rule expression, see Options.ExternalURL.
+	GeneratorURL string
+
+	ActiveAt        time.Time
+	FiredAt         time.Time
+	ResolvedAt      time.Time
+	LastSentAt      time.Time
+	ValidUntil      time.Time
+	KeepFiringSince time.Time
+}
+
+// AlertingRule fires alerts for the series returned by its expression
+// once they have been present for the hold duration.
+type AlertingRule struct {
+	name          string
+	expr          string
+	holdDuration  time.Duration
+	keepFiringFor time.Duration
+	labels        map[string]string
+	annotations   map[string]string
+
+	externalLabels map[string]string
+	externalURL    *url.URL
+
+	mu     sync.Mutex
+	active map[string]*Alert
+	// last holds the ALERTS series written by the previous evaluation.
+	last map[string][]prompb.Label
+}
+
+// NewAlertingRule returns a rule named name. Label and annotation values
+// are Go templates with access to $labels, $value, $externalLabels and
+// $externalURL, as in Prometheus.
+func NewAlertingRule(name, expr string, holdDuration, keepFiringFor time.Duration, labels, annotations map[string]string, opts Options) *AlertingRule {
+	r := &AlertingRule{
+		name:           name,
+		expr:           expr,
+		holdDuration:   holdDuration,
+		keepFiringFor:  keepFiringFor,
+		labels:         labels,
+		annotations:    annotations,
+		externalLabels: opts.ExternalLabels,
+		active:         make(map[string]*Alert),
+	}
+	if len(opts.ExternalURL) != 0 {
+		r.externalURL, _ = url.Parse(opts.ExternalURL)
+	}
+	return r
+}
+
+func (r *AlertingRule) Name() string {
+	return r.name
+}
+
+// Eval updates the state of the alerts and returns their ALERTS series.
+func (r *AlertingRule) Eval(ctx context.Context, client *promutil.Client, ts time.Time) ([]prompb.TimeSeries, error) {
+	samples, err := query(ctx, client, r.expr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	queryFunc := func(ctx context.Context, q string, ts time.Time) (promql.Vector, error) {
+		result, err := query(ctx, client, q, ts)
+		if err != nil {
+			return nil, err
+		}
+		return toPromqlVector(result), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[string]struct{}, len(samples))
+	for _, s := range samples {
+		metric := make(map[string]string, len(s.Metric))
+		for k, v := range s.Metric {
+			if k != model.MetricNameLabel {
+				metric[k] = v
+			}
+		}
+		data := template.AlertTemplateData(metric, r.externalLabels, r.externalURLString(), promql.Sample{F: s.Value.Value})
+		expand := func(text string) string {
+			tmpl := template.NewTemplateExpander(ctx, templateDefs+text, "__alert_"+r.name, data,
+				model.TimeFromUnixNano(ts.UnixNano()), queryFunc, r.externalURL, nil)
+			result, err := tmpl.Expand()
+			if err != nil {
+				log.Warnf("[%s] failed to expand template: %v", r.name, err)
+				return fmt.Sprintf("<error expanding template: %s>", err)
+			}
+			return result
+		}
+
+		lset := metric
+		for k, v := range r.labels {
+			lset[k] = expand(v)
+		}
+		lset[alertNameLabel] = r.name
+		annotations := make(map[string]string, len(r.annotations))
+		for k, v := range r.annotations {
+			annotations[k] = expand(v)
+		}
+
+		key := labelsKey(toLabels(lset))
+		if _, ok := seen[key]; ok {
+			return nil, fmt.Errorf("vector contains metrics with the same labelset after applying alert labels")
+		}
+		seen[key] = struct{}{}
+
+		if alert, ok := r.active[key]; ok && alert.State != StateInactive {
+			alert.Value = s.Value.Value
+			alert.Annotations = annotations
+			continue
+		}
+		r.active[key] = &Alert{
+			State:        StatePending,
+			Labels:       lset,
+			Annotations:  annotations,
+			Value:        s.Value.Value,
+			GeneratorURL: r.generatorURL(),
+			ActiveAt:     ts,
+		}
+	}
+
+	for key, alert := range r.active {
+		if _, ok := seen[key]; !ok {
+			if alert.State == StateFiring && r.keepFiringFor > 0 {
+				if alert.KeepFiringSince.IsZero() {
+					alert.KeepFiringSince = ts
+				}
+				if ts.Sub(alert.KeepFiringSince) < r.keepFiringFor {
+					continue
+				}
+			}
+			if alert.State == StatePending || (!alert.ResolvedAt.IsZero() && ts.Sub(alert.ResolvedAt) > resolvedRetention) {
+				delete(r.active, key)
+			}
+			if alert.State != StateInactive {
+				alert.State = StateInactive
+				alert.ResolvedAt = ts
+			}
+			continue
+		}
+		alert.KeepFiringSince = time.Time{}
+		if alert.State == StatePending && ts.Sub(alert.ActiveAt) >= r.holdDuration {
+			alert.State = StateFiring
+			alert.FiredAt = ts
+		}
+	}
+
+	tsMs := ts.UnixMilli()
+	current := make(map[string][]prompb.Label, len(r.active))
+	series := make([]prompb.TimeSeries, 0, len(r.active))
+	for _, alert := range r.active {
+		if alert.State == StateInactive {
+			continue
+		}
+		lset := make(map[string]string, len(alert.Labels)+2)
+		for k, v := range alert.Labels {
+			lset[k] = v
+		}
+		lset[model.MetricNameLabel] = alertMetricName
+		lset[alertStateLabel] = alert.State.String()
+		labels := toLabels(lset)
+		current[labelsKey(labels)] = labels
+		series = append(series, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: 1, Timestamp: tsMs}},
+		})
+	}
+	series = append(series, staleSeries(r.last, current, tsMs)...)
+	r.last = current
+	return series, nil
+}
+
+// Alerts returns a copy of the pending, firing and recently resolved
+// alerts, ordered by labels.
+func (r *AlertingRule) Alerts() []Alert {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(r.active))
+	for _, alert := range r.active {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return labelsKey(toLabels(alerts[i].Labels)) < labelsKey(toLabels(alerts[j].Labels))
+	})
+	return alerts
+}
+
+// alertsToSend returns the firing and resolved alerts that weren't sent
+// within resendDelay and marks them as sent at ts.
+func (r *AlertingRule) alertsToSend(ts time.Time, resendDelay, interval time.Duration) []Alert {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var alerts []Alert
+	for _, alert := range r.active {
+		if alert.State == StatePending {
+			continue
+		}
+		// resolved alerts are sent right away, then resent like firing ones
+		if alert.State == StateInactive && alert.ResolvedAt.After(alert.LastSentAt) {
+			alert.LastSentAt = ts
+			alerts = append(alerts, *alert)
+			continue
+		}
+		if ts.Sub(alert.LastSentAt) < resendDelay {
+			continue
+		}
+		delta := resendDelay
+		if interval > delta {
+			delta = interval
+		}
+		alert.ValidUntil = ts.Add(4 * delta)
+		alert.LastSentAt = ts
+		alerts = append(alerts, *alert)
+	}
+	return alerts
+}
+
+func (r *AlertingRule) externalURLString() string {
+	if r.externalURL == nil {
+		return ""
+	}
+	return r.externalURL.String()
+}
+
+// generatorURL links an alert to its expression in the graph UI of the
+// external URL.
+func (r *AlertingRule) generatorURL() string {
+	if r.externalURL == nil {
+		return ""
+	}
+	return strings.TrimSuffix(r.externalURL.String(), "/") + "/graph?g0.expr=" + url.QueryEscape(r.expr) + "&g0.tab=1"
+}
+
+func toPromqlVector(samples promutil.InstantVector) promql.Vector {
+	vector := make(promql.Vector, 0, len(samples))
+	for _, s := range samples {
+		vector = append(vector, promql.Sample{
+			Metric: labels.FromMap(s.Metric),
+			T:      s.Value.Timestamp.UnixMilli(),
+			F:      s.Value.Value,
+		})
+	}
+	return vector
+}
@@ -0,0 +1,95 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rosenlo/toolkits/promutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAlertRules = `
+groups:
+  - name: availability
+    rules:
+      - alert: InstanceDown
+        expr: up == 0
+        for: 2m
+        keep_firing_for: 1m
+        labels:
+          severity: page
+        annotations:
+          summary: "{{ $labels.instance }} of {{ $externalLabels.cluster }} is down ({{ $value }})"
+`
+
+func TestAlertingRule(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		mu   sync.Mutex
+		sent [][]postableAlert
+	)
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(AlertmanagerV2Alerts, r.URL.Path)
+		var alerts []postableAlert
+		assert.NoError(json.NewDecoder(r.Body).Decode(&alerts))
+		mu.Lock()
+		sent = append(sent, alerts)
+		mu.Unlock()
+	}))
+	defer am.Close()
+
+	down := `[{"metric":{"__name__":"up","instance":"host:9100"},"value":[0,"0"]}]`
+	result := down
+	sink := promutil.NewMemorySink()
+	client := newTestServer(t, sink, func(string) string { return result })
+
+	groups, err := Load([]byte(testAlertRules), client, Options{
+		Notifier:       NewNotifier(am.URL, nil),
+		ExternalLabels: map[string]string{"cluster": "eu1"},
+		ExternalURL:    "http://prometheus.example",
+	})
+	assert.NoError(err)
+	g := groups[0]
+	rule := g.Rules()[0].(*AlertingRule)
+	ctx := context.Background()
+	ts := time.Unix(1700000000, 0)
+
+	eval := func(d time.Duration) Alert {
+		sink.Reset()
+		assert.NoError(g.Eval(ctx, ts.Add(d)))
+		alerts := rule.Alerts()
+		assert.Len(alerts, 1)
+		return alerts[0]
+	}
+
+	alert := eval(0)
+	assert.Equal(StatePending, alert.State)
+	assert.Equal("host:9100 of eu1 is down (0)", alert.Annotations["summary"])
+	assert.Equal(map[string]string{"alertname": "InstanceDown", "instance": "host:9100", "severity": "page"}, alert.Labels)
+	assert.Len(sink.Find("ALERTS"), 1)
+	assert.Empty(sent)
+
+	assert.Equal(StatePending, eval(time.Minute).State)
+	alert = eval(2 * time.Minute)
+	assert.Equal(StateFiring, alert.State)
+	// the pending ALERTS series is marked stale when the alert fires
+	assert.Len(sink.Find("ALERTS"), 2)
+	assert.Len(sent, 1)
+	assert.Equal("eu1", sent[0][0].Labels["cluster"])
+	assert.Equal(ts.Add(2*time.Minute).UTC(), sent[0][0].StartsAt.UTC())
+	assert.Contains(sent[0][0].GeneratorURL, "http://prometheus.example/graph?g0.expr=up+%3D%3D+0")
+
+	// keep_firing_for holds the alert for a minute after it clears
+	result = `[]`
+	assert.Equal(StateFiring, eval(3*time.Minute).State)
+	alert = eval(4 * time.Minute)
+	assert.Equal(StateInactive, alert.State)
+	assert.Len(sent, 3)
+	assert.Equal(ts.Add(4*time.Minute).UTC(), sent[2][0].EndsAt.UTC())
+}
@@ -0,0 +1,78 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rosenlo/toolkits/http/httpclient"
+)
+
+const AlertmanagerV2Alerts = "/api/v2/alerts"
+
+// Notifier posts alerts to the Alertmanager v2 API.
+type Notifier struct {
+	client  *httpclient.Client
+	address string
+}
+
+// NewNotifier returns a notifier for the Alertmanager at address, e.g.
+// http://alertmanager:9093. A nil client uses httpclient.New(nil).
+func NewNotifier(address string, client *httpclient.Client) *Notifier {
+	if client == nil {
+		client = httpclient.New(nil)
+	}
+	return &Notifier{
+		client:  client,
+		address: strings.TrimSuffix(address, "/"),
+	}
+}
+
+type postableAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt,omitempty"`
+	EndsAt       time.Time         `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Send posts alerts in a single request. Firing alerts end at their
+// ValidUntil, resolved ones at their ResolvedAt.
+func (n *Notifier) Send(ctx context.Context, alerts []Alert) error {
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	payload := make([]postableAlert, 0, len(alerts))
+	for _, alert := range alerts {
+		pa := postableAlert{
+			Labels:       alert.Labels,
+			Annotations:  alert.Annotations,
+			StartsAt:     alert.FiredAt,
+			EndsAt:       alert.ValidUntil,
+			GeneratorURL: alert.GeneratorURL,
+		}
+		if alert.State == StateInactive {
+			pa.EndsAt = alert.ResolvedAt
+		}
+		payload = append(payload, pa)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	resp, respBody, err := n.client.RequestWithContext(ctx, "POST", n.address+AlertmanagerV2Alerts, headers, body)
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", AlertmanagerV2Alerts, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alertmanager returned %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+// Package rules evaluates Prometheus rule groups against a promutil.Client,
+// writes the results back through remote write and sends alerts to
+// Alertmanager.
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rosenlo/toolkits/log"
+	"github.com/rosenlo/toolkits/promutil"
+)
+
+const (
+	DefaultInterval    = time.Minute
+	DefaultResendDelay = time.Minute
+)
+
+var (
+	groupDuration *prometheus.HistogramVec
+	groupErrors   *prometheus.CounterVec
+)
+
+func init() {
+	groupDuration, _ = promutil.NewHistogramVec("promutil_rule_group_duration_seconds", "Duration of a rule group evaluation.", nil, []string{"group"})
+	groupErrors, _ = promutil.NewErrorCounterVec("promutil_rule_group", "Failed rule group evaluations.", []string{"group"})
+}
+
+// Rule is a recording or alerting rule.
+type Rule interface {
+	Name() string
+	// Eval queries the rule expression at ts and returns the series to
+	// write.
+	Eval(ctx context.Context, client *promutil.Client, ts time.Time) ([]prompb.TimeSeries, error)
+}
+
+type Options struct {
+	// Interval of groups that don't set one, defaults to DefaultInterval.
+	Interval time.Duration
+
+	// Notifier receives the alerts of alerting rules; without one alerts
+	// are only written as ALERTS series.
+	Notifier *Notifier
+	// ResendDelay is the minimum delay before a firing alert is sent
+	// again, defaults to DefaultResendDelay.
+	ResendDelay time.Duration
+	// ExternalLabels are added to sent alerts and available to templates
+	// as $externalLabels.
+	ExternalLabels map[string]string
+	// ExternalURL is used for the generator URL of alerts and available to
+	// templates as $externalURL.
+	ExternalURL string
+}
+
+// Group is a list of rules evaluated sequentially at a fixed interval.
+type Group struct {
+	name        string
+	interval    time.Duration
+	queryOffset time.Duration
+	client      *promutil.Client
+	rules       []Rule
+
+	notifier       *Notifier
+	resendDelay    time.Duration
+	externalLabels map[string]string
+}
+
+// LoadFile parses a Prometheus rule file, see Load.
+func LoadFile(path string, client *promutil.Client, opts Options) ([]*Group, error) {
+	groups, errs := rulefmt.ParseFile(path, false)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return newGroups(groups, client, opts)
+}
+
+// Load parses Prometheus rule-group YAML into groups evaluated with
+// client.
+func Load(content []byte, client *promutil.Client, opts Options) ([]*Group, error) {
+	groups, errs := rulefmt.Parse(content, false)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return newGroups(groups, client, opts)
+}
+
+func newGroups(groups *rulefmt.RuleGroups, client *promutil.Client, opts Options) ([]*Group, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.ResendDelay <= 0 {
+		opts.ResendDelay = DefaultResendDelay
+	}
+
+	result := make([]*Group, 0, len(groups.Groups))
+	for _, rg := range groups.Groups {
+		g := &Group{
+			name:           rg.Name,
+			interval:       time.Duration(rg.Interval),
+			client:         client,
+			notifier:       opts.Notifier,
+			resendDelay:    opts.ResendDelay,
+			externalLabels: opts.ExternalLabels,
+		}
+		if g.interval <= 0 {
+			g.interval = opts.Interval
+		}
+		if rg.QueryOffset != nil {
+			g.queryOffset = time.Duration(*rg.QueryOffset)
+		}
+		for _, node := range rg.Rules {
+			labels := mergeLabels(rg.Labels, node.Labels)
+			if len(node.Record.Value) != 0 {
+				g.rules = append(g.rules, NewRecordingRule(node.Record.Value, node.Expr.Value, labels, rg.Limit))
+				continue
+			}
+			g.rules = append(g.rules, NewAlertingRule(node.Alert.Value, node.Expr.Value,
+				time.Duration(node.For), time.Duration(node.KeepFiringFor), labels, node.Annotations, opts))
+		}
+		result = append(result, g)
+	}
+	return result, nil
+}
+
+func (g *Group) Name() string {
+	return g.name
+}
+
+func (g *Group) Interval() time.Duration {
+	return g.interval
+}
+
+func (g *Group) Rules() []Rule {
+	return g.rules
+}
+
+// Run evaluates the group at every multiple of its interval until ctx is
+// cancelled.
+func (g *Group) Run(ctx context.Context) {
+	next := time.Now().Truncate(g.interval).Add(g.interval)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if err := g.Eval(ctx, next); err != nil && ctx.Err() == nil {
+			log.Warnf("[%s] rule group evaluation failed: %v", g.name, err)
+		}
+
+		// skip the iterations missed by a slow evaluation
+		next = next.Add(g.interval)
+		if now := time.Now(); next.Before(now) {
+			next = now.Truncate(g.interval).Add(g.interval)
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// Eval evaluates every rule at ts minus the group query_offset, writes
+// their series in a single request and sends the alerts due to the
+// notifier. A failing rule doesn't stop the others; all errors are
+// returned joined.
+func (g *Group) Eval(ctx context.Context, ts time.Time) error {
+	start := time.Now()
+	defer func() {
+		groupDuration.WithLabelValues(g.name).Observe(time.Since(start).Seconds())
+	}()
+
+	ts = ts.Add(-g.queryOffset)
+	req := &prompb.WriteRequest{}
+	var errs []error
+	for _, rule := range g.rules {
+		series, err := rule.Eval(ctx, g.client, ts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %q: %w", rule.Name(), err))
+		}
+		req.Timeseries = append(req.Timeseries, series...)
+	}
+
+	if len(req.Timeseries) > 0 {
+		if err := g.client.Send(ctx, req); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %d series: %w", len(req.Timeseries), err))
+		}
+	}
+
+	if g.notifier != nil {
+		if err := g.notifier.Send(ctx, g.alertsToSend(ts)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send alerts: %w", err))
+		}
+	}
+
+	err := errors.Join(errs...)
+	if err != nil {
+		groupErrors.WithLabelValues(g.name).Inc()
+	}
+	return err
+}
+
+func (g *Group) alertsToSend(ts time.Time) []Alert {
+	var alerts []Alert
+	for _, rule := range g.rules {
+		ar, ok := rule.(*AlertingRule)
+		if !ok {
+			continue
+		}
+		for _, alert := range ar.alertsToSend(ts, g.resendDelay, g.interval) {
+			if len(g.externalLabels) > 0 {
+				alert.Labels = mergeLabels(g.externalLabels, alert.Labels)
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
+
+// RecordingRule stores the result of an expression as a new metric.
+type RecordingRule struct {
+	name   string
+	expr   string
+	labels map[string]string
+	limit  int
+
+	// last holds the label sets written by the previous evaluation, so
+	// series that disappear get a staleness marker.
+	last map[string][]prompb.Label
+}
+
+// NewRecordingRule returns a rule writing expr as metric name with labels
+// added. A positive limit fails evaluations returning more series.
+func NewRecordingRule(name, expr string, labels map[string]string, limit int) *RecordingRule {
+	return &RecordingRule{
+		name:   name,
+		expr:   expr,
+		labels: labels,
+		limit:  limit,
+	}
+}
+
+func (r *RecordingRule) Name() string {
+	return r.name
+}
+
+func (r *RecordingRule) Eval(ctx context.Context, client *promutil.Client, ts time.Time) ([]prompb.TimeSeries, error) {
+	samples, err := query(ctx, client, r.expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	if r.limit > 0 && len(samples) > r.limit {
+		return nil, fmt.Errorf("%d series exceed the limit of %d", len(samples), r.limit)
+	}
+
+	tsMs := ts.UnixMilli()
+	current := make(map[string][]prompb.Label, len(samples))
+	series := make([]prompb.TimeSeries, 0, len(samples))
+	for _, s := range samples {
+		lset := make(map[string]string, len(s.Metric)+len(r.labels)+1)
+		for k, v := range s.Metric {
+			lset[k] = v
+		}
+		for k, v := range r.labels {
+			lset[k] = v
+		}
+		lset[model.MetricNameLabel] = r.name
+
+		labels := toLabels(lset)
+		key := labelsKey(labels)
+		if _, ok := current[key]; ok {
+			return nil, fmt.Errorf("vector contains metrics with the same labelset after applying rule labels")
+		}
+		current[key] = labels
+		series = append(series, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: s.Value.Value, Timestamp: tsMs}},
+		})
+	}
+
+	series = append(series, staleSeries(r.last, current, tsMs)...)
+	r.last = current
+	return series, nil
+}
+
+// query runs an instant query and returns its result as a vector; a
+// scalar result becomes a single sample without labels.
+func query(ctx context.Context, client *promutil.Client, expr string, ts time.Time) (promutil.InstantVector, error) {
+	resp, err := client.QueryWithContext(ctx, expr, ts, "")
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Data.ResultType {
+	case promutil.ValueTypeVector:
+		return resp.Data.Vector, nil
+	case promutil.ValueTypeScalar:
+		return promutil.InstantVector{{Metric: map[string]string{}, Value: promutil.Point(*resp.Data.Scalar)}}, nil
+	}
+	return nil, fmt.Errorf("unsupported result type %q", resp.Data.ResultType)
+}
+
+// staleSeries returns a staleness marker at ts for every series of last
+// that isn't in current.
+func staleSeries(last, current map[string][]prompb.Label, ts int64) []prompb.TimeSeries {
+	var series []prompb.TimeSeries
+	for key, labels := range last {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		series = append(series, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: math.Float64frombits(value.StaleNaN), Timestamp: ts}},
+		})
+	}
+	return series
+}
+
+func mergeLabels(sets ...map[string]string) map[string]string {
+	result := make(map[string]string)
+	for _, set := range sets {
+		for k, v := range set {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func toLabels(lset map[string]string) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(lset))
+	for k, v := range lset {
+		if len(v) == 0 {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: k, Value: v})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+func labelsKey(labels []prompb.Label) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.Name)
+		sb.WriteByte(0xff)
+		sb.WriteString(l.Value)
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
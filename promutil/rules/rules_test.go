@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/rosenlo/toolkits/promutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRules = `
+groups:
+  - name: http
+    interval: 30s
+    labels:
+      team: web
+    rules:
+      - record: job:http_requests:rate5m
+        expr: sum by (job) (rate(http_requests_total[5m]))
+`
+
+// newTestServer answers instant queries with the vector returned by
+// result and stores remote writes in sink.
+func newTestServer(t *testing.T, sink *promutil.MemorySink, result func(query string) string) *promutil.Client {
+	mux := http.NewServeMux()
+	mux.HandleFunc(promutil.V1Query, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":` + result(r.URL.Query().Get("query")) + `}}`))
+	})
+	mux.Handle(promutil.V1Write, promutil.NewReceiver(sink))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return promutil.NewClient(promutil.Config{Address: srv.URL, InsertAddress: srv.URL})
+}
+
+func TestRecordingRule(t *testing.T) {
+	assert := assert.New(t)
+
+	result := `[{"metric":{"job":"api"},"value":[0,"1.5"]},{"metric":{"job":"web"},"value":[0,"2"]}]`
+	sink := promutil.NewMemorySink()
+	client := newTestServer(t, sink, func(string) string { return result })
+
+	groups, err := Load([]byte(testRules), client, Options{})
+	assert.NoError(err)
+	assert.Len(groups, 1)
+	g := groups[0]
+	assert.Equal(30*time.Second, g.Interval())
+
+	ts := time.Unix(1700000000, 0)
+	assert.NoError(g.Eval(context.Background(), ts))
+	series := sink.Find("job:http_requests:rate5m")
+	assert.Len(series, 2)
+	for _, s := range series {
+		assert.Contains(s.Labels, prompb.Label{Name: "team", Value: "web"})
+		assert.Equal(ts.UnixMilli(), s.Samples[0].Timestamp)
+	}
+
+	// the web series disappears and gets a staleness marker
+	sink.Reset()
+	result = `[{"metric":{"job":"api"},"value":[0,"3"]}]`
+	assert.NoError(g.Eval(context.Background(), ts.Add(30*time.Second)))
+	series = sink.Find("job:http_requests:rate5m")
+	assert.Len(series, 2)
+	for _, s := range series {
+		if s.Labels[1].Value == "web" {
+			assert.True(value.IsStaleNaN(s.Samples[0].Value))
+		} else {
+			assert.Equal(3.0, s.Samples[0].Value)
+			assert.False(math.IsNaN(s.Samples[0].Value))
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	_, err := Load([]byte("groups:\n  - name: x\n    rules:\n      - record: a\n        expr: 'sum('\n"), nil, Options{})
+	assert.Error(t, err)
+}
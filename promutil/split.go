@@ -0,0 +1,176 @@
+package promutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rosenlo/toolkits/semaphore"
+)
+
+const (
+	DefaultSplitMaxPoints   = 10000
+	DefaultSplitConcurrency = 4
+)
+
+type SplitOptions struct {
+	// MaxPoints is the maximum number of steps per chunk.
+	MaxPoints int
+	// Concurrency bounds the number of chunks queried at once.
+	Concurrency int
+}
+
+type timeRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// QueryRangeSplit runs a range query in chunks of at most MaxPoints steps,
+// so long ranges stay below the backend's per-query limits. Chunks are
+// aligned to step from start and queried concurrently; the resulting
+// matrices are merged per series with duplicate timestamps removed.
+func (c *Client) QueryRangeSplit(ctx context.Context, query string, start, end time.Time, step time.Duration, opts SplitOptions) (*QueryRangeResponse, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if opts.MaxPoints <= 0 {
+		opts.MaxPoints = DefaultSplitMaxPoints
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultSplitConcurrency
+	}
+
+	chunks := splitRange(start, end, step, opts.MaxPoints)
+	stepStr := strconv.FormatFloat(step.Seconds(), 'f', -1, 64)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		firstErr  error
+		responses = make([]*QueryRangeResponse, len(chunks))
+	)
+	sem := semaphore.NewSemaphore(opts.Concurrency)
+	for i := range chunks {
+		sem.Acquire()
+		if ctx.Err() != nil {
+			sem.Release()
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer sem.Release()
+
+			resp, err := c.QueryRangeWithContext(ctx, query, chunks[i].start, chunks[i].end, stepStr)
+			if err == nil && resp.Data.ResultType != ValueTypeMatrix {
+				err = fmt.Errorf("unexpected result type %q", resp.Data.ResultType)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+				return
+			}
+			responses[i] = resp
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return MergeRangeResponses(responses), nil
+}
+
+func splitRange(start, end time.Time, step time.Duration, maxPoints int) []timeRange {
+	chunk := time.Duration(maxPoints-1) * step
+	var ranges []timeRange
+	for s := start; !s.After(end); s = s.Add(chunk + step) {
+		e := s.Add(chunk)
+		if e.After(end) {
+			e = end
+		}
+		ranges = append(ranges, timeRange{start: s, end: e})
+	}
+	return ranges
+}
+
+// MergeRangeResponses merges matrix responses per series, sorting points
+// by time and dropping duplicate timestamps.
+func MergeRangeResponses(responses []*QueryRangeResponse) *QueryRangeResponse {
+	result := &QueryRangeResponse{
+		Status: StatusSuccess,
+		Data:   QueryData{ResultType: ValueTypeMatrix, Matrix: RangeVector{}},
+	}
+
+	index := make(map[string]int)
+	warnings := make(map[string]struct{})
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+		for _, w := range resp.Warnings {
+			if _, ok := warnings[w]; !ok {
+				warnings[w] = struct{}{}
+				result.Warnings = append(result.Warnings, w)
+			}
+		}
+		for _, series := range resp.Data.Matrix {
+			key := labelsKey(series.Metric)
+			i, ok := index[key]
+			if !ok {
+				i = len(result.Data.Matrix)
+				index[key] = i
+				result.Data.Matrix = append(result.Data.Matrix, MatrixSeries{Metric: series.Metric})
+			}
+			result.Data.Matrix[i].Values = append(result.Data.Matrix[i].Values, series.Values...)
+		}
+	}
+
+	for i := range result.Data.Matrix {
+		result.Data.Matrix[i].Values = dedupPoints(result.Data.Matrix[i].Values)
+	}
+	return result
+}
+
+func dedupPoints(points []Point) []Point {
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	result := points[:0]
+	for _, p := range points {
+		if len(result) > 0 && result[len(result)-1].Timestamp.Equal(p.Timestamp) {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+func labelsKey(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for k := range metric {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, k := range names {
+		sb.WriteString(k)
+		sb.WriteByte(0xff)
+		sb.WriteString(metric[k])
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
@@ -0,0 +1,54 @@
+package promutil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryRangeSplit(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		start, _ := parseTimestamp(r.URL.Query().Get("start"))
+		end, _ := parseTimestamp(r.URL.Query().Get("end"))
+		step, _ := strconv.ParseFloat(r.URL.Query().Get("step"), 64)
+
+		// include the point before start to simulate an overlapping boundary
+		var values []Point
+		for ts := start.Add(-time.Duration(step) * time.Second); !ts.After(end); ts = ts.Add(time.Duration(step) * time.Second) {
+			values = append(values, Point{Timestamp: ts, Value: float64(ts.Unix())})
+		}
+		json.NewEncoder(w).Encode(QueryRangeResponse{
+			Status: StatusSuccess,
+			Data: QueryData{ResultType: ValueTypeMatrix, Matrix: RangeVector{
+				{Metric: map[string]string{"__name__": "up"}, Values: values},
+			}},
+		})
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{Address: srv.URL})
+	start := time.Unix(1700000000, 0)
+	end := start.Add(99 * time.Minute)
+	resp, err := c.QueryRangeSplit(context.Background(), "up", start, end, time.Minute, SplitOptions{MaxPoints: 10, Concurrency: 3})
+	assert.NoError(err)
+	assert.Equal(int64(10), calls.Load())
+	assert.Len(resp.Data.Matrix, 1)
+
+	values := resp.Data.Matrix[0].Values
+	assert.Len(values, 101)
+	for i := 1; i < len(values); i++ {
+		assert.Equal(time.Minute, values[i].Timestamp.Sub(values[i-1].Timestamp))
+	}
+	assert.Equal(end, values[len(values)-1].Timestamp)
+}
@@ -0,0 +1,97 @@
+package promutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tenantKey struct{}
+
+// Tenant identifies a VictoriaMetrics cluster tenant.
+type Tenant struct {
+	AccountID uint32
+	ProjectID uint32
+}
+
+// ParseTenant parses "accountID" or "accountID:projectID".
+func ParseTenant(s string) (Tenant, error) {
+	var t Tenant
+	account, project, hasProject := strings.Cut(s, ":")
+	id, err := strconv.ParseUint(account, 10, 32)
+	if err != nil {
+		return t, fmt.Errorf("invalid tenant %q: bad accountID", s)
+	}
+	t.AccountID = uint32(id)
+	if hasProject {
+		id, err = strconv.ParseUint(project, 10, 32)
+		if err != nil {
+			return t, fmt.Errorf("invalid tenant %q: bad projectID", s)
+		}
+		t.ProjectID = uint32(id)
+	}
+	return t, nil
+}
+
+func (t Tenant) String() string {
+	if t.ProjectID == 0 {
+		return strconv.FormatUint(uint64(t.AccountID), 10)
+	}
+	return fmt.Sprintf("%d:%d", t.AccountID, t.ProjectID)
+}
+
+// WithTenant returns a context that routes the requests made with it to
+// tenant instead of Config.Tenant. The client must be configured for a
+// cluster, i.e. Config.Tenant must be set.
+func WithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set by WithTenant.
+func TenantFromContext(ctx context.Context) (Tenant, bool) {
+	t, ok := ctx.Value(tenantKey{}).(Tenant)
+	return t, ok
+}
+
+// selectURL returns the vmselect URL of a read path, prefixed with
+// /select/<tenant>/prometheus in cluster mode.
+func (c *Client) selectURL(ctx context.Context, path string) (string, error) {
+	prefix, err := c.tenantPrefix(ctx, "select")
+	if err != nil {
+		return "", err
+	}
+	return c.cfg.Address + prefix + path, nil
+}
+
+// insertURL returns the vminsert URL of a write path, prefixed with
+// /insert/<tenant>/prometheus in cluster mode. An empty InsertAddress
+// falls back to Address, as for a single-node server.
+func (c *Client) insertURL(ctx context.Context, path string) (string, error) {
+	prefix, err := c.tenantPrefix(ctx, "insert")
+	if err != nil {
+		return "", err
+	}
+	address := c.cfg.InsertAddress
+	if len(address) == 0 {
+		address = c.cfg.Address
+	}
+	return address + prefix + path, nil
+}
+
+func (c *Client) tenantPrefix(ctx context.Context, component string) (string, error) {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		if len(c.cfg.Tenant) == 0 {
+			return "", nil
+		}
+		var err error
+		tenant, err = ParseTenant(c.cfg.Tenant)
+		if err != nil {
+			return "", err
+		}
+	} else if len(c.cfg.Tenant) == 0 {
+		return "", fmt.Errorf("tenant %s set on a client without Config.Tenant", tenant)
+	}
+	return "/" + component + "/" + tenant.String() + "/prometheus", nil
+}
@@ -0,0 +1,71 @@
+package promutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	tenant, err := ParseTenant("42")
+	assert.NoError(err)
+	assert.Equal(Tenant{AccountID: 42}, tenant)
+	assert.Equal("42", tenant.String())
+
+	tenant, err = ParseTenant("42:7")
+	assert.NoError(err)
+	assert.Equal(Tenant{AccountID: 42, ProjectID: 7}, tenant)
+	assert.Equal("42:7", tenant.String())
+
+	for _, s := range []string{"", "a", "1:", "1:b", "-1"} {
+		_, err = ParseTenant(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestTenantRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{Address: srv.URL, InsertAddress: srv.URL, Tenant: "1:2"})
+	ctx := context.Background()
+
+	_, err := c.QueryWithContext(ctx, "up", time.Time{}, "")
+	assert.NoError(err)
+	assert.NoError(c.Write(ctx, nil))
+	assert.NoError(c.Import(WithTenant(ctx, Tenant{AccountID: 3}), "up 1"))
+
+	assert.Equal([]string{
+		"/select/1:2/prometheus" + V1Query,
+		"/insert/1:2/prometheus" + V1Write,
+		"/insert/3/prometheus" + V1Import,
+	}, paths)
+
+	single := NewClient(Config{Address: srv.URL})
+	assert.Error(single.Write(WithTenant(ctx, Tenant{AccountID: 3}), nil))
+
+	invalid := NewClient(Config{Address: srv.URL, Tenant: "x"})
+	assert.Error(invalid.Write(ctx, nil))
+}
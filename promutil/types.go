@@ -1,35 +1,267 @@
 package promutil
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StatusSuccess = "success"
+	StatusError   = "error"
+)
+
+type ValueType string
+
+const (
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeString ValueType = "string"
+)
+
 type Sample struct {
 	Metric     map[string]string `json:"metric"`
 	Values     []float64         `json:"values"`
 	Timestamps []int64           `json:"timestamps"`
 }
 
-type QueryResponse struct {
-	Status string `json:"status"`
-	Data   struct {
-		Result []struct {
-			Metric map[string]string `json:"metric"`
-			Value  []any             `json:"value"`
-		}
+// Point is a single [<unix_time>, "<value>"] pair as returned by the
+// Prometheus HTTP API.
+type Point struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+func (p *Point) UnmarshalJSON(b []byte) error {
+	ts, value, err := unmarshalPair(b)
+	if err != nil {
+		return err
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sample value %q: %w", value, err)
 	}
+	p.Timestamp = ts
+	p.Value = v
+	return nil
 }
 
-type QueryRangeResponse struct {
-	Status string `json:"status"`
-	Data   struct {
-		Result []struct {
-			Metric struct {
-				InstanceName string `json:"instance_name"`
-				Instance     string `json:"instance"`
-			}
-			Values [][]any `json:"values"`
-		}
+func (p Point) MarshalJSON() ([]byte, error) {
+	return marshalPair(p.Timestamp, strconv.FormatFloat(p.Value, 'f', -1, 64))
+}
+
+type VectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  Point             `json:"value"`
+}
+
+type MatrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []Point           `json:"values"`
+}
+
+type InstantVector []VectorSample
+
+type RangeVector []MatrixSeries
+
+type Scalar Point
+
+func (s *Scalar) UnmarshalJSON(b []byte) error {
+	return (*Point)(s).UnmarshalJSON(b)
+}
+
+func (s Scalar) MarshalJSON() ([]byte, error) {
+	return Point(s).MarshalJSON()
+}
+
+type String struct {
+	Timestamp time.Time
+	Value     string
+}
+
+func (s *String) UnmarshalJSON(b []byte) error {
+	ts, value, err := unmarshalPair(b)
+	if err != nil {
+		return err
 	}
+	s.Timestamp = ts
+	s.Value = value
+	return nil
+}
+
+func (s String) MarshalJSON() ([]byte, error) {
+	return marshalPair(s.Timestamp, s.Value)
 }
 
+// QueryData holds the decoded "data" object of a query response. Only the
+// field matching ResultType is populated.
+type QueryData struct {
+	ResultType ValueType
+	Vector     InstantVector
+	Matrix     RangeVector
+	Scalar     *Scalar
+	String     *String
+}
+
+func (d *QueryData) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		ResultType ValueType       `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*d = QueryData{ResultType: raw.ResultType}
+	if len(raw.Result) == 0 {
+		return nil
+	}
+
+	switch raw.ResultType {
+	case ValueTypeVector:
+		return json.Unmarshal(raw.Result, &d.Vector)
+	case ValueTypeMatrix:
+		return json.Unmarshal(raw.Result, &d.Matrix)
+	case ValueTypeScalar:
+		d.Scalar = new(Scalar)
+		return json.Unmarshal(raw.Result, d.Scalar)
+	case ValueTypeString:
+		d.String = new(String)
+		return json.Unmarshal(raw.Result, d.String)
+	default:
+		return fmt.Errorf("unknown result type %q", raw.ResultType)
+	}
+}
+
+func (d QueryData) MarshalJSON() ([]byte, error) {
+	var result any
+	switch d.ResultType {
+	case ValueTypeVector:
+		result = d.Vector
+	case ValueTypeMatrix:
+		result = d.Matrix
+	case ValueTypeScalar:
+		result = d.Scalar
+	case ValueTypeString:
+		result = d.String
+	}
+	return json.Marshal(struct {
+		ResultType ValueType `json:"resultType"`
+		Result     any       `json:"result"`
+	}{d.ResultType, result})
+}
+
+type QueryResponse struct {
+	Status    string    `json:"status"`
+	Data      QueryData `json:"data"`
+	ErrorType string    `json:"errorType,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Warnings  []string  `json:"warnings,omitempty"`
+}
+
+// QueryRangeResponse is the response of QueryRange, always holding a
+// matrix. It has the fields of QueryResponse and converts to it.
+type QueryRangeResponse QueryResponse
+
 type LabelValuesResponse struct {
 	Status string   `json:"status"`
 	Data   []string `json:"data"`
 }
+
+// apiResponse is the envelope shared by the Prometheus HTTP API endpoints.
+type apiResponse[T any] struct {
+	Status    string   `json:"status"`
+	Data      T        `json:"data"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+type MetricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+type TSDBStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+type HeadStats struct {
+	NumSeries     uint64 `json:"numSeries"`
+	NumLabelPairs int    `json:"numLabelPairs"`
+	ChunkCount    int64  `json:"chunkCount"`
+	MinTime       int64  `json:"minTime"`
+	MaxTime       int64  `json:"maxTime"`
+}
+
+// TSDBStatus is the cardinality report of /api/v1/status/tsdb. TotalSeries,
+// TotalLabelValuePairs and SeriesCountByFocusLabelValue are only returned
+// by VictoriaMetrics, HeadStats only by Prometheus.
+type TSDBStatus struct {
+	HeadStats                    *HeadStats `json:"headStats,omitempty"`
+	TotalSeries                  uint64     `json:"totalSeries"`
+	TotalLabelValuePairs         uint64     `json:"totalLabelValuePairs"`
+	SeriesCountByMetricName      []TSDBStat `json:"seriesCountByMetricName"`
+	SeriesCountByLabelName       []TSDBStat `json:"seriesCountByLabelName"`
+	SeriesCountByFocusLabelValue []TSDBStat `json:"seriesCountByFocusLabelValue"`
+	SeriesCountByLabelValuePair  []TSDBStat `json:"seriesCountByLabelValuePair"`
+	LabelValueCountByLabelName   []TSDBStat `json:"labelValueCountByLabelName"`
+	MemoryInBytesByLabelName     []TSDBStat `json:"memoryInBytesByLabelName"`
+}
+
+func unmarshalPair(b []byte) (time.Time, string, error) {
+	var pair [2]json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return time.Time{}, "", err
+	}
+	ts, err := parseTimestamp(string(pair[0]))
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	var value string
+	if err := json.Unmarshal(pair[1], &value); err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid sample value %s: %w", pair[1], err)
+	}
+	return ts, value, nil
+}
+
+func marshalPair(ts time.Time, value string) ([]byte, error) {
+	return json.Marshal([2]any{json.Number(formatTimestamp(ts)), value})
+}
+
+// parseTimestamp parses a unix timestamp in seconds with an optional
+// fractional part without going through float64, so millisecond
+// precision is preserved.
+func parseTimestamp(s string) (time.Time, error) {
+	sec, frac, _ := strings.Cut(s, ".")
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q: %w", s, err)
+	}
+	var nsecs int64
+	if len(frac) > 0 {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nsecs, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q: %w", s, err)
+		}
+		for i := len(frac); i < 9; i++ {
+			nsecs *= 10
+		}
+		if strings.HasPrefix(sec, "-") {
+			nsecs = -nsecs
+		}
+	}
+	return time.Unix(secs, nsecs), nil
+}
+
+func formatTimestamp(ts time.Time) string {
+	return strconv.FormatFloat(float64(ts.UnixMilli())/1e3, 'f', -1, 64)
+}
@@ -0,0 +1,112 @@
+package promutil
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryResponseVector(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"status":"success","warnings":["partial response"],"data":{"resultType":"vector","result":[
+		{"metric":{"__name__":"up","job":"node","instance":"a:9100","zone":"z1"},"value":[1435781451.781,"1"]},
+		{"metric":{"__name__":"up","job":"node","instance":"b:9100"},"value":[1435781451,"NaN"]},
+		{"metric":{"__name__":"up","job":"node","instance":"c:9100"},"value":[1435781451,"+Inf"]}
+	]}}`
+
+	resp, err := parseQueryResponse([]byte(body))
+	assert.NoError(err)
+	assert.Equal([]string{"partial response"}, resp.Warnings)
+	assert.Equal(ValueTypeVector, resp.Data.ResultType)
+	assert.Len(resp.Data.Vector, 3)
+	assert.Equal("z1", resp.Data.Vector[0].Metric["zone"])
+	assert.Equal(time.UnixMilli(1435781451781), resp.Data.Vector[0].Value.Timestamp)
+	assert.Equal(1.0, resp.Data.Vector[0].Value.Value)
+	assert.True(math.IsNaN(resp.Data.Vector[1].Value.Value))
+	assert.True(math.IsInf(resp.Data.Vector[2].Value.Value, 1))
+}
+
+func TestQueryResponseMatrix(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"instance_name":"db1","instance":"a","role":"primary"},"values":[[1435781430,"1"],[1435781445.5,"2.5"]]}
+	]}}`
+
+	resp, err := parseQueryResponse([]byte(body))
+	assert.NoError(err)
+	assert.Equal(ValueTypeMatrix, resp.Data.ResultType)
+	assert.Len(resp.Data.Matrix, 1)
+	assert.Equal("primary", resp.Data.Matrix[0].Metric["role"])
+	assert.Equal([]Point{
+		{Timestamp: time.Unix(1435781430, 0), Value: 1},
+		{Timestamp: time.UnixMilli(1435781445500), Value: 2.5},
+	}, resp.Data.Matrix[0].Values)
+}
+
+func TestQueryResponseScalarAndString(t *testing.T) {
+	assert := assert.New(t)
+
+	resp, err := parseQueryResponse([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1435781451.781,"-Inf"]}}`))
+	assert.NoError(err)
+	assert.True(math.IsInf(resp.Data.Scalar.Value, -1))
+
+	resp, err = parseQueryResponse([]byte(`{"status":"success","data":{"resultType":"string","result":[1435781451,"hello"]}}`))
+	assert.NoError(err)
+	assert.Equal("hello", resp.Data.String.Value)
+	assert.Equal(time.Unix(1435781451, 0), resp.Data.String.Timestamp)
+
+	b, err := json.Marshal(resp.Data)
+	assert.NoError(err)
+	assert.JSONEq(`{"resultType":"string","result":[1435781451,"hello"]}`, string(b))
+}
+
+func TestQueryResponseError(t *testing.T) {
+	assert := assert.New(t)
+
+	var err error = newAPIError(400, []byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+	var apiErr *APIError
+	assert.True(errors.As(err, &apiErr))
+	assert.Equal("bad_data", apiErr.Type)
+	assert.Equal("parse error", apiErr.Message)
+	assert.Equal(400, apiErr.StatusCode)
+
+	_, err = parseQueryResponse([]byte(`{"status":"error","errorType":"timeout","error":"query timed out"}`))
+	assert.True(errors.As(err, &apiErr))
+	assert.Equal("timeout", apiErr.Type)
+}
+
+func TestDecodeSamples(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"metric":{"__name__":"up","job":"node"},"values":[1,0],"timestamps":[1549891472010,1549891487724]}
+{"metric":{"__name__":"up","job":"vm"},"values":[1],"timestamps":[1549891461511]}
+`
+	var samples []*Sample
+	err := DecodeSamples(strings.NewReader(body), func(s *Sample) error {
+		samples = append(samples, s)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Len(samples, 2)
+	assert.Equal("vm", samples[1].Metric["job"])
+
+	req := SamplesToWriteRequest(samples)
+	assert.Len(req.Timeseries, 2)
+	assert.Equal("__name__", req.Timeseries[0].Labels[0].Name)
+	assert.Equal(int64(1549891487724), req.Timeseries[0].Samples[1].Timestamp)
+
+	count := 0
+	err = DecodeSamples(strings.NewReader(body), func(s *Sample) error {
+		count++
+		return ErrStopExport
+	})
+	assert.NoError(err)
+	assert.Equal(1, count)
+}
@@ -1,7 +1,9 @@
 package promutil
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/rosenlo/toolkits/log"
 
@@ -19,79 +21,209 @@ const (
 
 var DefBuckets = []float64{.001, .0015, .002, .003, .005, .01, .025, .05, .1, .25, .5, .75, 1, 1.5, 2.5, 3, 3.5, 5, 7.5, 10}
 
-func NewHistogramVec(name, help string, buckets []float64, labels []string) (*prometheus.HistogramVec, error) {
+var DefObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+const (
+	DefNativeHistogramBucketFactor = 1.1
+	DefNativeHistogramMaxBuckets   = 160
+	// DefNativeHistogramMinResetDuration is how long a native histogram
+	// waits after its last reset before it may reset again to stay within
+	// DefNativeHistogramMaxBuckets.
+	DefNativeHistogramMinResetDuration = time.Hour
+)
+
+type MetricOption func(*metricOptions)
+
+type metricOptions struct {
+	registerer  prometheus.Registerer
+	namespace   string
+	subsystem   string
+	constLabels prometheus.Labels
+
+	nativeHistogramMinResetDuration time.Duration
+}
+
+func newMetricOptions(opts []MetricOption) metricOptions {
+	o := metricOptions{
+		registerer:                      prometheus.DefaultRegisterer,
+		nativeHistogramMinResetDuration: DefNativeHistogramMinResetDuration,
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return o
+}
+
+// WithRegisterer registers the collector with r instead of
+// prometheus.DefaultRegisterer. A nil r skips registration.
+func WithRegisterer(r prometheus.Registerer) MetricOption {
+	return func(o *metricOptions) {
+		o.registerer = r
+	}
+}
+
+// WithNamespace prefixes the metric name with namespace.
+func WithNamespace(namespace string) MetricOption {
+	return func(o *metricOptions) {
+		o.namespace = namespace
+	}
+}
+
+// WithSubsystem prefixes the metric name with subsystem, after the
+// namespace.
+func WithSubsystem(subsystem string) MetricOption {
+	return func(o *metricOptions) {
+		o.subsystem = subsystem
+	}
+}
+
+// WithConstLabels attaches labels with fixed values to every series.
+func WithConstLabels(labels prometheus.Labels) MetricOption {
+	return func(o *metricOptions) {
+		o.constLabels = labels
+	}
+}
+
+// WithNativeHistogramMinResetDuration sets how long a native histogram
+// waits after its last reset before it may reset again when it has too many
+// buckets, defaults to DefNativeHistogramMinResetDuration. Only used by
+// NewNativeHistogramVec.
+func WithNativeHistogramMinResetDuration(d time.Duration) MetricOption {
+	return func(o *metricOptions) {
+		o.nativeHistogramMinResetDuration = d
+	}
+}
+
+// register registers metric and returns it. If an identical collector is
+// already registered, that one is returned instead, so constructors can be
+// called more than once with the same arguments.
+func register[T prometheus.Collector](name string, metric T, o metricOptions) (T, error) {
+	if o.registerer == nil {
+		return metric, nil
+	}
+	err := o.registerer.Register(metric)
+	if err == nil {
+		return metric, nil
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+	var zero T
+	return zero, fmt.Errorf("[%s] failed to register: %w", name, err)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels []string, opts ...MetricOption) (*prometheus.HistogramVec, error) {
 	log.Debugf("[%s] register with labels: %v", name, labels)
 	if len(buckets) == 0 {
 		buckets = DefBuckets
 	}
+	o := newMetricOptions(opts)
 	metric := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    name,
-			Help:    help,
-			Buckets: buckets,
+			Namespace:   o.namespace,
+			Subsystem:   o.subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: o.constLabels,
+			Buckets:     buckets,
 		},
 		labels,
 	)
-
-	if err := prometheus.Register(metric); err != nil {
-		return nil, fmt.Errorf("[%s] failed to register: %w", name, err)
-	}
-
-	return metric, nil
+	return register(name, metric, o)
 }
 
-func NewGaugeVec(name, help string, labels []string) (*prometheus.GaugeVec, error) {
+// NewNativeHistogramVec returns a histogram with native (sparse) buckets
+// only. bucketFactor is the maximum growth between two buckets, defaults
+// to DefNativeHistogramBucketFactor. See WithNativeHistogramMinResetDuration
+// for how often it may reset to bound the number of buckets.
+func NewNativeHistogramVec(name, help string, bucketFactor float64, labels []string, opts ...MetricOption) (*prometheus.HistogramVec, error) {
 	log.Debugf("[%s] register with labels: %v", name, labels)
-	metric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: name,
-			Help: help,
+	if bucketFactor <= 1 {
+		bucketFactor = DefNativeHistogramBucketFactor
+	}
+	o := newMetricOptions(opts)
+	metric := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:                       o.namespace,
+			Subsystem:                       o.subsystem,
+			Name:                            name,
+			Help:                            help,
+			ConstLabels:                     o.constLabels,
+			NativeHistogramBucketFactor:     bucketFactor,
+			NativeHistogramMaxBucketNumber:  DefNativeHistogramMaxBuckets,
+			NativeHistogramMinResetDuration: o.nativeHistogramMinResetDuration,
 		},
 		labels,
 	)
+	return register(name, metric, o)
+}
 
-	if err := prometheus.Register(metric); err != nil {
-		return nil, fmt.Errorf("[%s] failed to register: %w", name, err)
+// NewSummaryVec returns a summary with the given quantile objectives,
+// defaults to DefObjectives.
+func NewSummaryVec(name, help string, objectives map[float64]float64, labels []string, opts ...MetricOption) (*prometheus.SummaryVec, error) {
+	log.Debugf("[%s] register with labels: %v", name, labels)
+	if len(objectives) == 0 {
+		objectives = DefObjectives
 	}
-
-	return metric, nil
+	o := newMetricOptions(opts)
+	metric := prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:   o.namespace,
+			Subsystem:   o.subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: o.constLabels,
+			Objectives:  objectives,
+		},
+		labels,
+	)
+	return register(name, metric, o)
 }
 
-func NewErrorCounterVec(name, help string, labels []string) (*prometheus.CounterVec, error) {
-	metricName := fmt.Sprintf("%s_%s", name, ErrorMetricNameSuffix)
-	log.Debugf("[%s] register with labels: %v", metricName, labels)
-	metric := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: metricName,
-			Help: help,
+func NewGaugeVec(name, help string, labels []string, opts ...MetricOption) (*prometheus.GaugeVec, error) {
+	log.Debugf("[%s] register with labels: %v", name, labels)
+	o := newMetricOptions(opts)
+	metric := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   o.namespace,
+			Subsystem:   o.subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: o.constLabels,
 		},
 		labels,
 	)
+	return register(name, metric, o)
+}
 
-	if err := prometheus.Register(metric); err != nil {
-		return nil, fmt.Errorf("[%s] failed to register: %w", metricName, err)
-	}
-
-	return metric, nil
+func NewErrorCounterVec(name, help string, labels []string, opts ...MetricOption) (*prometheus.CounterVec, error) {
+	metricName := fmt.Sprintf("%s_%s", name, ErrorMetricNameSuffix)
+	return NewCounterVec(metricName, help, labels, opts...)
 }
 
-func NewCounterVec(name, help string, labels []string) (*prometheus.CounterVec, error) {
+func NewCounterVec(name, help string, labels []string, opts ...MetricOption) (*prometheus.CounterVec, error) {
 	log.Debugf("[%s] register with labels: %v", name, labels)
+	o := newMetricOptions(opts)
 	metric := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: name,
-			Help: help,
+			Namespace:   o.namespace,
+			Subsystem:   o.subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: o.constLabels,
 		},
 		labels,
 	)
-
-	if err := prometheus.Register(metric); err != nil {
-		return nil, fmt.Errorf("[%s] failed to register: %w", name, err)
-	}
-
-	return metric, nil
+	return register(name, metric, o)
 }
 
+// ResetIfReached resets vec once it holds limit series or more.
+//
+// Deprecated: ResetIfReached drops every series, use CardinalityGuard to
+// evict only the least recently updated ones.
 func ResetIfReached(vec Vector, limit int) {
 	ch := make(chan prometheus.Metric, 1024)
 	cch := ch
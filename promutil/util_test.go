@@ -0,0 +1,61 @@
+package promutil
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCounterVecIdempotent(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	opts := []MetricOption{
+		WithRegisterer(reg),
+		WithNamespace("app"),
+		WithSubsystem("http"),
+		WithConstLabels(prometheus.Labels{"region": "eu"}),
+	}
+	first, err := NewCounterVec("requests_total", "h", []string{"code"}, opts...)
+	assert.NoError(err)
+	second, err := NewCounterVec("requests_total", "h", []string{"code"}, opts...)
+	assert.NoError(err)
+	assert.Same(first, second)
+
+	second.WithLabelValues("200").Inc()
+	count, err := testutil.GatherAndCount(reg, "app_http_requests_total")
+	assert.NoError(err)
+	assert.Equal(1, count)
+
+	// same name but a different type is still an error
+	_, err = NewGaugeVec("requests_total", "h", []string{"code"}, opts...)
+	assert.Error(err)
+}
+
+func TestNewSummaryAndNativeHistogramVec(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	summary, err := NewSummaryVec("latency_seconds", "h", nil, []string{"path"}, WithRegisterer(reg))
+	assert.NoError(err)
+	summary.WithLabelValues("/").Observe(0.1)
+
+	hist, err := NewNativeHistogramVec("size_bytes", "h", 0, []string{"path"}, WithRegisterer(reg))
+	assert.NoError(err)
+	hist.WithLabelValues("/").Observe(512)
+
+	mfs, err := reg.Gather()
+	assert.NoError(err)
+	assert.Len(mfs, 2)
+	for _, mf := range mfs {
+		if mf.GetName() == "size_bytes" {
+			h := mf.Metric[0].Histogram
+			assert.Empty(h.Bucket)
+			assert.True(IsNativeHistogram(h))
+		} else {
+			assert.Len(mf.Metric[0].Summary.Quantile, len(DefObjectives))
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package promutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+const (
+	RemoteWriteVersion1 = "0.1.0"
+	RemoteWriteVersion2 = "2.0.0"
+
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+
+	RemoteWriteVersionHeader = "X-Prometheus-Remote-Write-Version"
+
+	// Headers of 2.0 responses counting the elements the receiver wrote.
+	RemoteWriteSamplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	RemoteWriteHistogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	RemoteWriteExemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+
+	contentTypeV1 = "application/x-protobuf;proto=prometheus.WriteRequest"
+	contentTypeV2 = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+)
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// ErrPartialWrite is returned by Send when a 2.0 receiver confirms fewer
+// samples, histograms or exemplars than were sent. It is not retried.
+var ErrPartialWrite = errors.New("remote write receiver wrote partial data")
+
+// WithRemoteWriteVersion selects the message format used by Send and by
+// everything writing through it: BatchRemoteWrite, QueueManager,
+// DiskBuffer and Pusher. With RemoteWriteVersion2 the client falls back to
+// 1.0 for good once the receiver answers 415 Unsupported Media Type.
+func WithRemoteWriteVersion(version string) Option {
+	return func(c *Client) {
+		c.writeVersion = version
+	}
+}
+
+// WithCompression selects the Content-Encoding of remote write requests.
+// CompressionZstd is understood by VictoriaMetrics but not by Prometheus.
+func WithCompression(compression string) Option {
+	return func(c *Client) {
+		c.compression = compression
+	}
+}
+
+// WriteV2 sends a marshaled writev2.Request (remote write 2.0).
+func (c *Client) WriteV2(ctx context.Context, payload []byte) error {
+	_, err := c.write(ctx, payload, RemoteWriteVersion2)
+	return err
+}
+
+// Send writes req using the configured remote write version. With 2.0 the
+// written counts returned by the receiver are checked, see
+// ErrPartialWrite; receivers that don't return them are trusted.
+func (c *Client) Send(ctx context.Context, req *prompb.WriteRequest) error {
+	if c.useV2() {
+		data, err := ToWriteRequestV2(req).Marshal()
+		if err != nil {
+			return err
+		}
+		header, err := c.write(ctx, data, RemoteWriteVersion2)
+		if err == nil {
+			return checkWritten(req, header)
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnsupportedMediaType {
+			return err
+		}
+		c.v2Unsupported.Store(true)
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	return c.Write(ctx, data)
+}
+
+// sendPayload is Send for a marshaled 1.0 request, which is only decoded
+// when 2.0 is used.
+func (c *Client) sendPayload(ctx context.Context, payload []byte) error {
+	if !c.useV2() {
+		return c.Write(ctx, payload)
+	}
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(payload); err != nil {
+		return err
+	}
+	return c.Send(ctx, &req)
+}
+
+func (c *Client) useV2() bool {
+	return c.writeVersion == RemoteWriteVersion2 && !c.v2Unsupported.Load()
+}
+
+// checkWritten compares the counts confirmed by the written headers of a
+// 2.0 response with what req holds.
+func checkWritten(req *prompb.WriteRequest, header http.Header) error {
+	var sent [3]int64
+	for _, ts := range req.Timeseries {
+		sent[0] += int64(len(ts.Samples))
+		sent[1] += int64(len(ts.Histograms))
+		sent[2] += int64(len(ts.Exemplars))
+	}
+
+	var errs []error
+	for i, name := range []string{RemoteWriteSamplesWrittenHeader, RemoteWriteHistogramsWrittenHeader, RemoteWriteExemplarsWrittenHeader} {
+		value := header.Get(name)
+		if len(value) == 0 {
+			continue
+		}
+		written, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s header %q: %w", name, value, err)
+		}
+		if written < sent[i] {
+			errs = append(errs, fmt.Errorf("%w: %s is %d of %d", ErrPartialWrite, name, written, sent[i]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Client) write(ctx context.Context, payload []byte, version string) (http.Header, error) {
+	_url, err := c.insertURL(ctx, V1Write)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"Content-Type":           contentTypeV1,
+		"Content-Encoding":       c.compression,
+		RemoteWriteVersionHeader: version,
+	}
+	if version == RemoteWriteVersion2 {
+		headers["Content-Type"] = contentTypeV2
+	}
+
+	var body []byte
+	switch c.compression {
+	case CompressionZstd:
+		body = zstdEncoder.EncodeAll(payload, nil)
+	default:
+		headers["Content-Encoding"] = CompressionSnappy
+		body = snappy.Encode(nil, payload)
+	}
+
+	resp, respBody, err := c.client.RequestWithContext(ctx, "POST", _url, headers, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request %s: %w", V1Write, err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.Header, nil
+	}
+
+	return nil, newAPIErrorFromResponse(resp, respBody)
+}
+
+// ToWriteRequestV2 converts req to the 2.0 format. Metadata in
+// req.Metadata is attached to the series of the matching metric family.
+func ToWriteRequestV2(req *prompb.WriteRequest) *writev2.Request {
+	symbols := writev2.NewSymbolTable()
+	metadata := make(map[string]writev2.Metadata, len(req.Metadata))
+	for _, m := range req.Metadata {
+		metadata[m.MetricFamilyName] = writev2.Metadata{
+			Type:    writev2.Metadata_MetricType(m.Type),
+			HelpRef: symbols.Symbolize(m.Help),
+			UnitRef: symbols.Symbolize(m.Unit),
+		}
+	}
+
+	result := &writev2.Request{Timeseries: make([]writev2.TimeSeries, 0, len(req.Timeseries))}
+	for _, ts := range req.Timeseries {
+		series := toTimeSeriesV2(&symbols, ts)
+		if len(metadata) > 0 {
+			series.Metadata = lookupMetadata(metadata, ts.Labels)
+		}
+		result.Timeseries = append(result.Timeseries, series)
+	}
+	result.Symbols = symbols.Symbols()
+	return result
+}
+
+// GatherWriteRequestV2 is like GatherWriteRequest but builds a 2.0 request
+// carrying HELP/TYPE/UNIT and created timestamps on every series.
+func GatherWriteRequestV2(g prometheus.Gatherer, jobName, instance string, opts ...BuildOption) (*writev2.Request, error) {
+	o := newBuildOptions(opts)
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+
+	symbols := writev2.NewSymbolTable()
+	result := &writev2.Request{}
+	mfs, err := g.Gather()
+	for _, mf := range mfs {
+		metadata := writev2.Metadata{
+			Type:    writev2.Metadata_MetricType(metricMetadataType(mf.GetType())),
+			HelpRef: symbols.Symbolize(mf.GetHelp()),
+			UnitRef: symbols.Symbolize(mf.GetUnit()),
+		}
+		for _, metric := range mf.Metric {
+			req := &prompb.WriteRequest{}
+			appendMetric(req, mf.GetName(), metric, jobName, instance, o.timestamp.UnixMilli())
+			createdTimestamp := createdTimestampMs(metric)
+			for _, ts := range req.Timeseries {
+				sortLabels(ts.Labels)
+				series := toTimeSeriesV2(&symbols, ts)
+				series.Metadata = metadata
+				series.CreatedTimestamp = createdTimestamp
+				result.Timeseries = append(result.Timeseries, series)
+			}
+		}
+	}
+	result.Symbols = symbols.Symbols()
+	return result, err
+}
+
+func toTimeSeriesV2(symbols *writev2.SymbolsTable, ts prompb.TimeSeries) writev2.TimeSeries {
+	series := writev2.TimeSeries{
+		LabelsRefs: make([]uint32, 0, len(ts.Labels)*2),
+		Samples:    make([]writev2.Sample, 0, len(ts.Samples)),
+	}
+	for _, l := range ts.Labels {
+		series.LabelsRefs = append(series.LabelsRefs, symbols.Symbolize(l.Name), symbols.Symbolize(l.Value))
+	}
+	for _, s := range ts.Samples {
+		series.Samples = append(series.Samples, writev2.Sample{Value: s.Value, Timestamp: s.Timestamp})
+	}
+	for _, h := range ts.Histograms {
+		series.Histograms = append(series.Histograms, toHistogramV2(h))
+	}
+	return series
+}
+
+func toHistogramV2(h prompb.Histogram) writev2.Histogram {
+	result := writev2.Histogram{
+		Sum:            h.Sum,
+		Schema:         h.Schema,
+		ZeroThreshold:  h.ZeroThreshold,
+		NegativeSpans:  make([]writev2.BucketSpan, 0, len(h.NegativeSpans)),
+		NegativeDeltas: h.NegativeDeltas,
+		NegativeCounts: h.NegativeCounts,
+		PositiveSpans:  make([]writev2.BucketSpan, 0, len(h.PositiveSpans)),
+		PositiveDeltas: h.PositiveDeltas,
+		PositiveCounts: h.PositiveCounts,
+		ResetHint:      writev2.Histogram_ResetHint(h.ResetHint),
+		Timestamp:      h.Timestamp,
+	}
+	switch count := h.Count.(type) {
+	case *prompb.Histogram_CountInt:
+		result.Count = &writev2.Histogram_CountInt{CountInt: count.CountInt}
+	case *prompb.Histogram_CountFloat:
+		result.Count = &writev2.Histogram_CountFloat{CountFloat: count.CountFloat}
+	}
+	switch count := h.ZeroCount.(type) {
+	case *prompb.Histogram_ZeroCountInt:
+		result.ZeroCount = &writev2.Histogram_ZeroCountInt{ZeroCountInt: count.ZeroCountInt}
+	case *prompb.Histogram_ZeroCountFloat:
+		result.ZeroCount = &writev2.Histogram_ZeroCountFloat{ZeroCountFloat: count.ZeroCountFloat}
+	}
+	for _, span := range h.NegativeSpans {
+		result.NegativeSpans = append(result.NegativeSpans, writev2.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+	for _, span := range h.PositiveSpans {
+		result.PositiveSpans = append(result.PositiveSpans, writev2.BucketSpan{Offset: span.Offset, Length: span.Length})
+	}
+	return result
+}
+
+// lookupMetadata finds the metadata of the family a series belongs to,
+// stripping the suffixes added for histograms and summaries.
+func lookupMetadata(metadata map[string]writev2.Metadata, labels []prompb.Label) writev2.Metadata {
+	var name string
+	for _, l := range labels {
+		if l.Name == model.MetricNameLabel {
+			name = l.Value
+			break
+		}
+	}
+	if m, ok := metadata[name]; ok {
+		return m
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if m, ok := metadata[strings.TrimSuffix(name, suffix)]; ok && strings.HasSuffix(name, suffix) {
+			return m
+		}
+	}
+	return writev2.Metadata{}
+}
+
+func createdTimestampMs(metric *dto.Metric) int64 {
+	switch {
+	case metric.Counter != nil && metric.Counter.CreatedTimestamp != nil:
+		return metric.Counter.CreatedTimestamp.AsTime().UnixMilli()
+	case metric.Summary != nil && metric.Summary.CreatedTimestamp != nil:
+		return metric.Summary.CreatedTimestamp.AsTime().UnixMilli()
+	case metric.Histogram != nil && metric.Histogram.CreatedTimestamp != nil:
+		return metric.Histogram.CreatedTimestamp.AsTime().UnixMilli()
+	}
+	return 0
+}
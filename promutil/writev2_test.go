@@ -0,0 +1,138 @@
+package promutil
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+var testWriteRequest = &prompb.WriteRequest{
+	Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "job", Value: "api"}},
+		Samples: []prompb.Sample{{Value: 3, Timestamp: 1000}},
+	}},
+	Metadata: []prompb.MetricMetadata{{
+		Type:             prompb.MetricMetadata_COUNTER,
+		MetricFamilyName: "http_requests_total",
+		Help:             "requests",
+	}},
+}
+
+func TestSendV2Zstd(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(RemoteWriteVersion2, r.Header.Get(RemoteWriteVersionHeader))
+		assert.Equal(CompressionZstd, r.Header.Get("Content-Encoding"))
+
+		body, _ := io.ReadAll(r.Body)
+		dec, _ := zstd.NewReader(nil)
+		data, err := dec.DecodeAll(body, nil)
+		assert.NoError(err)
+
+		var req writev2.Request
+		assert.NoError(req.Unmarshal(data))
+		assert.Len(req.Timeseries, 1)
+		ts := req.Timeseries[0]
+		assert.Equal("http_requests_total", req.Symbols[ts.LabelsRefs[1]])
+		assert.Equal(writev2.Metadata_METRIC_TYPE_COUNTER, ts.Metadata.Type)
+		assert.Equal("requests", req.Symbols[ts.Metadata.HelpRef])
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{InsertAddress: srv.URL}, WithRemoteWriteVersion(RemoteWriteVersion2), WithCompression(CompressionZstd))
+	assert.NoError(c.Send(context.Background(), testWriteRequest))
+}
+
+func TestSendV2FallbackToV1(t *testing.T) {
+	assert := assert.New(t)
+
+	var versions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versions = append(versions, r.Header.Get(RemoteWriteVersionHeader))
+		if r.Header.Get(RemoteWriteVersionHeader) == RemoteWriteVersion2 {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, body)
+		assert.NoError(err)
+		var req prompb.WriteRequest
+		assert.NoError(req.Unmarshal(data))
+		assert.Len(req.Timeseries, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{InsertAddress: srv.URL}, WithRemoteWriteVersion(RemoteWriteVersion2))
+	assert.NoError(c.Send(context.Background(), testWriteRequest))
+	assert.NoError(c.Send(context.Background(), testWriteRequest))
+	assert.Equal([]string{RemoteWriteVersion2, RemoteWriteVersion1, RemoteWriteVersion1}, versions)
+}
+
+func TestSendV2WrittenHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	var written string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(written) != 0 {
+			w.Header().Set(RemoteWriteSamplesWrittenHeader, written)
+			w.Header().Set(RemoteWriteHistogramsWrittenHeader, "0")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{InsertAddress: srv.URL}, WithRemoteWriteVersion(RemoteWriteVersion2))
+	ctx := context.Background()
+
+	// receivers without the headers are trusted
+	assert.NoError(c.Send(ctx, testWriteRequest))
+	written = "1"
+	assert.NoError(c.Send(ctx, testWriteRequest))
+	written = "0"
+	err := c.Send(ctx, testWriteRequest)
+	assert.ErrorIs(err, ErrPartialWrite)
+	assert.False(recoverable(err))
+}
+
+func TestRemoteWriteVersionPerClient(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var versions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		versions = append(versions, r.Header.Get(RemoteWriteVersionHeader))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{InsertAddress: srv.URL}, WithRemoteWriteVersion(RemoteWriteVersion2))
+	ctx := context.Background()
+
+	assert.NoError(BatchRemoteWrite(ctx, c, testWriteRequest, 10))
+
+	q := NewQueueManager(c, QueueConfig{Name: "v2"})
+	q.Start()
+	assert.NoError(q.AppendWriteRequest(testWriteRequest))
+	q.Stop()
+
+	b, err := NewDiskBuffer(c, DiskBufferConfig{Dir: t.TempDir()})
+	assert.NoError(err)
+	defer b.Close()
+	assert.NoError(b.Write(ctx, testWriteRequest))
+
+	assert.Equal([]string{RemoteWriteVersion2, RemoteWriteVersion2, RemoteWriteVersion2}, versions)
+}
@@ -5,12 +5,45 @@ import (
 	"runtime/debug"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rosenlo/toolkits/promutil"
 )
 
 const (
 	DefaultCleanDuration = time.Hour
 )
 
+var evictionsTotal *prometheus.CounterVec
+
+func init() {
+	evictionsTotal, _ = promutil.NewCounterVec("safemap_evictions_total", "Keys removed from safemaps by reason.", []string{"reason"})
+}
+
+// EvictionReason tells why a key left the map.
+type EvictionReason int
+
+const (
+	// EvictionExpired keys weren't accessed within their expiration.
+	EvictionExpired EvictionReason = iota
+	// EvictionDeleted keys were removed by the caller.
+	EvictionDeleted
+	// EvictionReplaced keys were overwritten by a Set of the same key.
+	EvictionReplaced
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionDeleted:
+		return "deleted"
+	case EvictionReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
 type KeyData struct {
 	Name         string
 	Value        interface{}
@@ -19,8 +52,15 @@ type KeyData struct {
 	Expiration   time.Duration
 }
 
+func (k *KeyData) stale(now time.Time) bool {
+	return now.UnixNano()-k.LastAccessAt.UnixNano() > k.Expiration.Nanoseconds()
+}
+
 type Options struct {
 	CleanDuration time.Duration
+	// OnEvicted is called with every key removed from the map and the
+	// reason, without holding the map lock.
+	OnEvicted func(key string, value interface{}, reason EvictionReason)
 }
 
 type Map struct {
@@ -51,9 +91,14 @@ func (s *Map) Set(key string, value interface{}, expiration time.Duration) {
 
 	s.Lock()
 
+	old, replaced := s.m[key]
 	s.m[key] = keyData
 
 	s.Unlock()
+
+	if replaced {
+		s.evicted(old, EvictionReplaced)
+	}
 }
 
 func (s *Map) Get(key string) (interface{}, bool) {
@@ -71,9 +116,37 @@ func (s *Map) Get(key string) (interface{}, bool) {
 func (s *Map) Remove(key string) {
 	s.Lock()
 
+	keyData, exists := s.m[key]
+	delete(s.m, key)
+
+	s.Unlock()
+
+	if exists {
+		s.evicted(keyData, EvictionDeleted)
+	}
+}
+
+// removeStale removes key unless it was set again since the scan.
+func (s *Map) removeStale(key string, now time.Time) {
+	s.Lock()
+
+	keyData, exists := s.m[key]
+	if !exists || !keyData.stale(now) {
+		s.Unlock()
+		return
+	}
 	delete(s.m, key)
 
 	s.Unlock()
+
+	s.evicted(keyData, EvictionExpired)
+}
+
+func (s *Map) evicted(keyData *KeyData, reason EvictionReason) {
+	evictionsTotal.WithLabelValues(reason.String()).Inc()
+	if s.opts.OnEvicted != nil {
+		s.opts.OnEvicted(keyData.Name, keyData.Value, reason)
+	}
 }
 
 func (s *Map) cleanStaleKey() {
@@ -97,14 +170,14 @@ func (s *Map) cleanStaleKey() {
 
 		s.RLock()
 		for key, keyData := range s.m {
-			if now.UnixNano()-keyData.LastAccessAt.UnixNano() > keyData.Expiration.Nanoseconds() {
+			if keyData.stale(now) {
 				deleteKeys = append(deleteKeys, key)
 			}
 		}
 		s.RUnlock()
 
 		for i := range deleteKeys {
-			s.Remove(deleteKeys[i])
+			s.removeStale(deleteKeys[i], now)
 		}
 
 		select {
@@ -1,6 +1,7 @@
 package safemap
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -41,3 +42,36 @@ func TestSafeMap(t *testing.T) {
 		assert.Equal(tests[i].result, result)
 	}
 }
+
+func TestSafeMapOnEvicted(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		mu      sync.Mutex
+		evicted = make(map[string]EvictionReason)
+	)
+	m := New(Options{
+		CleanDuration: 10 * time.Millisecond,
+		OnEvicted: func(key string, value interface{}, reason EvictionReason) {
+			mu.Lock()
+			evicted[key] = reason
+			mu.Unlock()
+		},
+	})
+	m.Set("replaced", 1, time.Minute)
+	m.Set("replaced", 2, time.Minute)
+	m.Set("deleted", 1, time.Minute)
+	m.Remove("deleted")
+	m.Set("expired", 1, time.Millisecond)
+
+	assert.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(evicted) == 3
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(map[string]EvictionReason{
+		"replaced": EvictionReplaced,
+		"deleted":  EvictionDeleted,
+		"expired":  EvictionExpired,
+	}, evicted)
+}
@@ -0,0 +1,57 @@
+package ttlsafemap
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rosenlo/toolkits/promutil"
+)
+
+var evictionsTotal *prometheus.CounterVec
+
+func init() {
+	evictionsTotal, _ = promutil.NewCounterVec("ttlsafemap_evictions_total", "Entries removed from ttlsafemap Caches by reason.", []string{"reason"})
+}
+
+// EvictionReason tells why an entry left a cache.
+type EvictionReason int
+
+const (
+	// EvictionExpired entries outlived their TTL.
+	EvictionExpired EvictionReason = iota
+	// EvictionDeleted entries were deleted by the caller.
+	EvictionDeleted
+	// EvictionReplaced entries were overwritten by a Set of the same key.
+	EvictionReplaced
+	// EvictionCapacity entries were dropped to stay within a size bound.
+	EvictionCapacity
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionDeleted:
+		return "deleted"
+	case EvictionReplaced:
+		return "replaced"
+	case EvictionCapacity:
+		return "capacity"
+	}
+	return "unknown"
+}
+
+type eviction[K comparable, V any] struct {
+	key    K
+	value  V
+	reason EvictionReason
+}
+
+// notifyEvicted passes evictions to fn. It must be called without holding
+// any cache lock, so fn may use the cache. Callers count the evictions in
+// their own metric.
+func notifyEvicted[K comparable, V any](fn func(K, V, EvictionReason), evicted []eviction[K, V]) {
+	for _, e := range evicted {
+		if fn != nil {
+			fn(e.key, e.value, e.reason)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package ttlsafemap
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder[K comparable] struct {
+	mu      sync.Mutex
+	reasons map[K]EvictionReason
+}
+
+func (r *recorder[K]) record(key K, reason EvictionReason) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reasons == nil {
+		r.reasons = make(map[K]EvictionReason)
+	}
+	r.reasons[key] = reason
+}
+
+func (r *recorder[K]) get() map[K]EvictionReason {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make(map[K]EvictionReason, len(r.reasons))
+	for k, v := range r.reasons {
+		result[k] = v
+	}
+	return result
+}
+
+func TestCacheOnEvicted(t *testing.T) {
+	assert := assert.New(t)
+
+	var rec recorder[string]
+	c := NewCache[string, int](time.Minute)
+	c.OnEvicted(func(key string, value int, reason EvictionReason) {
+		// the hook runs outside the lock and may use the cache
+		c.Len()
+		rec.record(key, reason)
+	})
+
+	c.Set("replaced", 1)
+	c.Set("replaced", 2)
+	c.Set("deleted", 1)
+	c.Delete("deleted")
+	c.Delete("missing")
+	c.SetWithTTL("read", 1, time.Nanosecond)
+	c.SetWithTTL("swept", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	c.Get("read")
+	c.deleteExpired()
+
+	assert.Equal(map[string]EvictionReason{
+		"replaced": EvictionReplaced,
+		"deleted":  EvictionDeleted,
+		"read":     EvictionExpired,
+		"swept":    EvictionExpired,
+	}, rec.get())
+}
+
+func TestShardMapOnEvicted(t *testing.T) {
+	assert := assert.New(t)
+
+	var rec recorder[uint64]
+	sm := NewShardMap(2)
+	sm.OnEvicted(func(key uint64, value any, reason EvictionReason) {
+		sm.Get(key)
+		rec.record(key, reason)
+	})
+
+	sm.Set(1, "a", time.Minute)
+	sm.Set(1, "b", time.Minute)
+	sm.Set(2, "a", time.Minute)
+	sm.Delete(2)
+	sm.Set(3, "a", time.Nanosecond)
+	sm.Set(4, "a", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	sm.Get(3)
+
+	sm.StartCleanupTimer(5 * time.Millisecond)
+	defer sm.Stop()
+	assert.Eventually(func() bool { return len(rec.get()) == 4 }, time.Second, 5*time.Millisecond)
+	assert.Equal(map[uint64]EvictionReason{
+		1: EvictionReplaced,
+		2: EvictionDeleted,
+		3: EvictionExpired,
+		4: EvictionExpired,
+	}, rec.get())
+}
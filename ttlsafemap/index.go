@@ -0,0 +1,82 @@
+package ttlsafemap
+
+import "container/heap"
+
+type expiryItem[K comparable] struct {
+	key        K
+	expiration int64
+	index      int
+}
+
+type expiryHeap[K comparable] []*expiryItem[K]
+
+func (h expiryHeap[K]) Len() int           { return len(h) }
+func (h expiryHeap[K]) Less(i, j int) bool { return h[i].expiration < h[j].expiration }
+func (h expiryHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap[K]) Push(x any) {
+	item := x.(*expiryItem[K])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap[K]) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// expiryIndex orders keys by expiration so expired keys are found without
+// scanning the whole map. It is not safe for concurrent use.
+type expiryIndex[K comparable] struct {
+	heap  expiryHeap[K]
+	items map[K]*expiryItem[K]
+}
+
+func newExpiryIndex[K comparable]() *expiryIndex[K] {
+	return &expiryIndex[K]{items: make(map[K]*expiryItem[K])}
+}
+
+// set records the expiration of key, zero removes it from the index.
+func (x *expiryIndex[K]) set(key K, expiration int64) {
+	if expiration == 0 {
+		x.remove(key)
+		return
+	}
+	if item, ok := x.items[key]; ok {
+		item.expiration = expiration
+		heap.Fix(&x.heap, item.index)
+		return
+	}
+	item := &expiryItem[K]{key: key, expiration: expiration}
+	x.items[key] = item
+	heap.Push(&x.heap, item)
+}
+
+func (x *expiryIndex[K]) remove(key K) {
+	item, ok := x.items[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&x.heap, item.index)
+	delete(x.items, key)
+}
+
+// popExpired removes and returns the keys that expired before now, in
+// expiration order.
+func (x *expiryIndex[K]) popExpired(now int64) []K {
+	var keys []K
+	for len(x.heap) > 0 && x.heap[0].expiration < now {
+		item := heap.Pop(&x.heap).(*expiryItem[K])
+		delete(x.items, item.key)
+		keys = append(keys, item.key)
+	}
+	return keys
+}
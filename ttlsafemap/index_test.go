@@ -0,0 +1,38 @@
+package ttlsafemap
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiryIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	x := newExpiryIndex[int]()
+	for _, i := range rand.Perm(100) {
+		x.set(i, int64(i+1))
+	}
+	// moving and removing keys keeps the heap ordered
+	x.set(10, 1000)
+	x.remove(20)
+	x.set(30, 0)
+
+	expired := x.popExpired(51)
+	assert.Len(expired, 47)
+	for i := 1; i < len(expired); i++ {
+		assert.Less(expired[i-1], expired[i])
+	}
+	assert.NotContains(expired, 10)
+	assert.NotContains(expired, 20)
+	assert.NotContains(expired, 30)
+
+	// only the remaining keys are left in the index
+	assert.Len(x.heap, 100-47-2)
+	assert.Len(x.items, len(x.heap))
+	assert.Empty(x.popExpired(51))
+	rest := x.popExpired(1001)
+	assert.Len(rest, 51)
+	assert.Equal(10, rest[len(rest)-1])
+}
@@ -1,3 +1,17 @@
+// Package ttlsafemap provides maps whose entries expire after a TTL: the
+// generic Cache and the sharded, optionally bounded ShardMap.
+//
+// Cache used to store any keys and values. It is now generic, which breaks
+// its callers:
+//
+//   - NewCache() becomes NewCache[K, V](defaultTTL); NewCache[any, any] keeps
+//     the untyped behaviour.
+//   - Set(key, value, ttl) becomes SetWithTTL(key, value, ttl); Set now uses
+//     the default TTL.
+//   - A TTL <= 0, such as NoExpiration, now keeps the entry until it is
+//     deleted. It used to store an entry that was already expired.
+//
+// ShardMap is unchanged: a TTL <= 0 still expires the entry right away.
 package ttlsafemap
 
 import (
@@ -5,65 +19,280 @@ import (
 	"time"
 )
 
+// NoExpiration as a TTL keeps a Cache entry until it is deleted. Any
+// TTL <= 0 does the same.
+const NoExpiration time.Duration = 0
+
 type Item struct {
 	Value      any
 	Expiration int64
 }
 
-type Cache struct {
-	syncMap sync.Map
+type entry[V any] struct {
+	value V
+	// expiration in unix nanoseconds, zero never expires
+	expiration int64
 }
 
-func NewCache() Cache {
-	return Cache{}
+func (e *entry[V]) expired(now int64) bool {
+	return e.expiration != 0 && now > e.expiration
 }
 
-func (c *Cache) Set(key any, value any, ttl time.Duration) {
-	expiration := time.Now().Add(ttl).UnixNano()
-	item := Item{Value: value, Expiration: expiration}
-	c.syncMap.Store(key, item)
+// Cache is a map whose entries expire after a TTL. Expired entries are
+// never returned; they are removed on access or by the cleanup timer,
+// which only visits expired entries.
+type Cache[K comparable, V any] struct {
+	mu         sync.RWMutex
+	m          map[K]*entry[V]
+	index      *expiryIndex[K]
+	defaultTTL time.Duration
+	onEvicted  func(K, V, EvictionReason)
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewCache returns a cache whose entries set without an explicit TTL
+// expire after defaultTTL, or never with NoExpiration.
+func NewCache[K comparable, V any](defaultTTL time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		m:          make(map[K]*entry[V]),
+		index:      newExpiryIndex[K](),
+		defaultTTL: defaultTTL,
+		stop:       make(chan struct{}),
+	}
 }
 
-func (c *Cache) Get(key any) (any, bool) {
-	value, ok := c.syncMap.Load(key)
+func (c *Cache[K, V]) newEntry(value V, ttl time.Duration) *entry[V] {
+	e := &entry[V]{value: value}
+	if ttl > 0 {
+		e.expiration = time.Now().Add(ttl).UnixNano()
+	}
+	return e
+}
+
+// OnEvicted sets fn to be called with every entry removed from the cache
+// and the reason. fn is called without holding the cache lock. It must be
+// set before the cache is used.
+func (c *Cache[K, V]) OnEvicted(fn func(key K, value V, reason EvictionReason)) {
+	c.onEvicted = fn
+}
+
+// Set stores value with the default TTL.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.defaultTTL)
+}
+
+// SetWithTTL stores value expiring after ttl, or never with NoExpiration.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	e := c.newEntry(value, ttl)
+
+	c.mu.Lock()
+	evicted := c.storeLocked(key, e, time.Now().UnixNano())
+	c.mu.Unlock()
+
+	c.notify(evicted)
+}
+
+// storeLocked stores e and returns the entry it replaced, if any.
+func (c *Cache[K, V]) storeLocked(key K, e *entry[V], now int64) []eviction[K, V] {
+	old, ok := c.m[key]
+	c.m[key] = e
+	c.index.set(key, e.expiration)
 	if !ok {
-		return nil, false
+		return nil
+	}
+	reason := EvictionReplaced
+	if old.expired(now) {
+		reason = EvictionExpired
 	}
+	return []eviction[K, V]{{key, old.value, reason}}
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.RLock()
+	e, ok := c.m[key]
+	c.mu.RUnlock()
+
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if e.expired(time.Now().UnixNano()) {
+		c.deleteExpiredKey(key, e)
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// GetOrSet returns the existing value of key if there is one; otherwise
+// it stores value with the default TTL and returns it. loaded reports
+// whether the value was already present.
+func (c *Cache[K, V]) GetOrSet(key K, value V) (actual V, loaded bool) {
+	now := time.Now().UnixNano()
 
-	item := value.(Item)
-	if time.Now().UnixNano() > item.Expiration {
-		c.Delete(key)
-		return nil, false
+	c.mu.Lock()
+	if e, ok := c.m[key]; ok && !e.expired(now) {
+		c.mu.Unlock()
+		return e.value, true
 	}
+	evicted := c.storeLocked(key, c.newEntry(value, c.defaultTTL), now)
+	c.mu.Unlock()
 
-	return item.Value, ok
+	c.notify(evicted)
+	return value, false
 }
 
-func (c *Cache) Delete(key any) {
-	c.syncMap.Delete(key)
+// Update atomically replaces the value of key with fn(value, ok), where ok
+// reports whether key was present. An existing entry keeps its expiration,
+// a new one gets the default TTL.
+func (c *Cache[K, V]) Update(key K, fn func(value V, ok bool) V) V {
+	now := time.Now().UnixNano()
+
+	c.mu.Lock()
+	if e, ok := c.m[key]; ok && !e.expired(now) {
+		e.value = fn(e.value, true)
+		c.mu.Unlock()
+		return e.value
+	}
+	var zero V
+	e := c.newEntry(fn(zero, false), c.defaultTTL)
+	evicted := c.storeLocked(key, e, now)
+	c.mu.Unlock()
+
+	c.notify(evicted)
+	return e.value
 }
 
-func (c *Cache) Keys() []any {
-	keys := make([]any, 0)
-	c.syncMap.Range(func(key, value any) bool {
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	e, ok := c.m[key]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	c.deleteLocked(key)
+	c.mu.Unlock()
+
+	reason := EvictionDeleted
+	if e.expired(time.Now().UnixNano()) {
+		reason = EvictionExpired
+	}
+	c.notify([]eviction[K, V]{{key, e.value, reason}})
+}
+
+// notify counts evictions and passes them to the OnEvicted callback.
+func (c *Cache[K, V]) notify(evicted []eviction[K, V]) {
+	for _, e := range evicted {
+		evictionsTotal.WithLabelValues(e.reason.String()).Inc()
+	}
+	notifyEvicted(c.onEvicted, evicted)
+}
+
+func (c *Cache[K, V]) deleteLocked(key K) {
+	delete(c.m, key)
+	c.index.remove(key)
+}
+
+// deleteExpiredKey deletes key only if it still maps to e, so a concurrent
+// Set isn't undone.
+func (c *Cache[K, V]) deleteExpiredKey(key K, e *entry[V]) {
+	c.mu.Lock()
+	if c.m[key] != e {
+		c.mu.Unlock()
+		return
+	}
+	c.deleteLocked(key)
+	c.mu.Unlock()
+
+	c.notify([]eviction[K, V]{{key, e.value, EvictionExpired}})
+}
+
+// Len returns the number of entries that haven't expired.
+func (c *Cache[K, V]) Len() int {
+	now := time.Now().UnixNano()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := 0
+	for _, e := range c.m {
+		if !e.expired(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Range calls fn for every entry that hasn't expired until fn returns
+// false. fn runs on a snapshot, so it may modify the cache.
+func (c *Cache[K, V]) Range(fn func(key K, value V) bool) {
+	type kv struct {
+		key   K
+		value V
+	}
+	now := time.Now().UnixNano()
+
+	c.mu.RLock()
+	snapshot := make([]kv, 0, len(c.m))
+	for k, e := range c.m {
+		if !e.expired(now) {
+			snapshot = append(snapshot, kv{k, e.value})
+		}
+	}
+	c.mu.RUnlock()
+
+	for _, item := range snapshot {
+		if !fn(item.key, item.value) {
+			return
+		}
+	}
+}
+
+func (c *Cache[K, V]) Keys() []K {
+	keys := make([]K, 0)
+	c.Range(func(key K, _ V) bool {
 		keys = append(keys, key)
 		return true
 	})
 	return keys
 }
 
-func (c *Cache) StartCleanupTimer(interval time.Duration) {
+// StartCleanupTimer removes expired entries every interval until Stop is
+// called.
+func (c *Cache[K, V]) StartCleanupTimer(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
-			c.syncMap.Range(func(key, value any) bool {
-				item := value.(Item)
-				if time.Now().UnixNano() > item.Expiration {
-					c.Delete(key)
-					return true
-				}
-				return false
-			})
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.deleteExpired()
+			}
 		}
 	}()
 }
+
+// Stop stops the cleanup timer. The cache stays usable.
+func (c *Cache[K, V]) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *Cache[K, V]) deleteExpired() {
+	now := time.Now().UnixNano()
+
+	c.mu.Lock()
+	keys := c.index.popExpired(now)
+	evicted := make([]eviction[K, V], 0, len(keys))
+	for _, key := range keys {
+		evicted = append(evicted, eviction[K, V]{key, c.m[key].value, EvictionExpired})
+		delete(c.m, key)
+	}
+	c.mu.Unlock()
+
+	c.notify(evicted)
+}
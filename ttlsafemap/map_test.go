@@ -0,0 +1,92 @@
+package ttlsafemap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCache[string, int](time.Minute)
+	c.Set("a", 1)
+	c.SetWithTTL("b", 2, time.Millisecond)
+	c.SetWithTTL("c", 3, NoExpiration)
+
+	v, ok := c.Get("a")
+	assert.True(ok)
+	assert.Equal(1, v)
+
+	time.Sleep(5 * time.Millisecond)
+	_, ok = c.Get("b")
+	assert.False(ok)
+	assert.Equal(2, c.Len())
+	assert.ElementsMatch([]string{"a", "c"}, c.Keys())
+
+	v, loaded := c.GetOrSet("a", 10)
+	assert.True(loaded)
+	assert.Equal(1, v)
+	v, loaded = c.GetOrSet("d", 4)
+	assert.False(loaded)
+	assert.Equal(4, v)
+
+	assert.Equal(2, c.Update("a", func(v int, ok bool) int { return v + 1 }))
+	assert.Equal(1, c.Update("e", func(v int, ok bool) int {
+		assert.False(ok)
+		return 1
+	}))
+
+	c.Delete("a")
+	_, ok = c.Get("a")
+	assert.False(ok)
+}
+
+func TestCacheCleanupTimer(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCache[int, string](time.Millisecond)
+	for i := 0; i < 100; i++ {
+		c.Set(i, "v")
+	}
+	c.SetWithTTL(100, "kept", time.Minute)
+
+	c.StartCleanupTimer(5 * time.Millisecond)
+	defer c.Stop()
+	assert.Eventually(func() bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return len(c.m) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	c.Stop()
+	c.Stop()
+}
+
+func TestCacheSweepIsComplete(t *testing.T) {
+	assert := assert.New(t)
+
+	// interleave expired and live entries, which stopped the old sweep at
+	// the first live entry
+	c := NewCache[int, int](time.Minute)
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			c.SetWithTTL(i, i, time.Nanosecond)
+		} else {
+			c.Set(i, i)
+		}
+	}
+	c.SetWithTTL(2000, 0, NoExpiration)
+	time.Sleep(time.Millisecond)
+
+	c.deleteExpired()
+	assert.Len(c.m, 501)
+	assert.Len(c.index.items, 500, "entries without expiration are not indexed")
+	assert.Equal(501, c.Len())
+
+	// deleting and replacing keys keeps the index in sync
+	c.Delete(1)
+	c.SetWithTTL(3, 3, NoExpiration)
+	assert.Len(c.index.items, 498)
+}
@@ -0,0 +1,292 @@
+package ttlsafemap
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// Policy chooses the entries a bounded ShardMap evicts when a shard is
+// over capacity. Each shard has its own policy and calls it with the shard
+// lock held, so implementations need no locking.
+type Policy interface {
+	// Add records a key inserted into the shard.
+	Add(key uint64)
+	// Access records a read or update of key. It is also called for reads
+	// of absent keys, which admission policies may count.
+	Access(key uint64)
+	// Remove forgets a key deleted or expired from the shard.
+	Remove(key uint64)
+	// Evict forgets and returns the key to evict next.
+	Evict() (uint64, bool)
+}
+
+// PolicyFactory returns the policy of a shard holding about capacity
+// entries.
+type PolicyFactory func(capacity int) Policy
+
+// NewLRU evicts the least recently used key.
+func NewLRU(int) Policy {
+	return newLRU()
+}
+
+type lruPolicy struct {
+	ll    *list.List
+	items map[uint64]*list.Element
+}
+
+func newLRU() *lruPolicy {
+	return &lruPolicy{ll: list.New(), items: make(map[uint64]*list.Element)}
+}
+
+func (p *lruPolicy) Add(key uint64) {
+	if e, ok := p.items[key]; ok {
+		p.ll.MoveToFront(e)
+		return
+	}
+	p.items[key] = p.ll.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key uint64) {
+	if e, ok := p.items[key]; ok {
+		p.ll.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key uint64) {
+	if e, ok := p.items[key]; ok {
+		p.ll.Remove(e)
+		delete(p.items, key)
+	}
+}
+
+func (p *lruPolicy) Evict() (uint64, bool) {
+	key, ok := p.victim()
+	if ok {
+		p.Remove(key)
+	}
+	return key, ok
+}
+
+func (p *lruPolicy) victim() (uint64, bool) {
+	e := p.ll.Back()
+	if e == nil {
+		return 0, false
+	}
+	return e.Value.(uint64), true
+}
+
+// NewLFU evicts the least frequently used key, the least recently used
+// one among equally frequent keys. The newest key is spared, otherwise it
+// would always be the one evicted.
+func NewLFU(int) Policy {
+	return &lfuPolicy{items: make(map[uint64]*lfuItem)}
+}
+
+type lfuItem struct {
+	key   uint64
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+type lfuPolicy struct {
+	heap   lfuHeap
+	items  map[uint64]*lfuItem
+	tick   uint64
+	newest *lfuItem
+}
+
+func (p *lfuPolicy) Add(key uint64) {
+	if _, ok := p.items[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.tick++
+	item := &lfuItem{key: key, freq: 1, tick: p.tick}
+	p.items[key] = item
+	p.newest = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *lfuPolicy) Access(key uint64) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	item.freq++
+	item.tick = p.tick
+	heap.Fix(&p.heap, item.index)
+}
+
+func (p *lfuPolicy) Remove(key uint64) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.heap, item.index)
+	delete(p.items, key)
+	if p.newest == item {
+		p.newest = nil
+	}
+}
+
+func (p *lfuPolicy) Evict() (uint64, bool) {
+	if len(p.heap) == 0 {
+		return 0, false
+	}
+	i := 0
+	if p.heap[0] == p.newest && len(p.heap) > 1 {
+		// the next victim is the smaller child of the root
+		i = 1
+		if len(p.heap) > 2 && p.heap.Less(2, 1) {
+			i = 2
+		}
+	}
+	key := p.heap[i].key
+	p.Remove(key)
+	return key, true
+}
+
+// NewTinyLFU evicts in LRU order behind a W-TinyLFU-style admission
+// filter: the newest key only displaces the LRU victim if a count-min
+// sketch of recent accesses, including reads of absent keys, has seen it
+// more often. Otherwise the new key itself is evicted, which keeps
+// one-hit wonders from flushing popular entries.
+func NewTinyLFU(capacity int) Policy {
+	return &tinyLFUPolicy{lru: newLRU(), sketch: newCMSketch(capacity)}
+}
+
+type tinyLFUPolicy struct {
+	lru    *lruPolicy
+	sketch *cmSketch
+
+	// candidate is the newest key, not yet admitted against a victim
+	candidate    uint64
+	hasCandidate bool
+}
+
+func (p *tinyLFUPolicy) Add(key uint64) {
+	p.sketch.add(key)
+	p.lru.Add(key)
+	p.candidate, p.hasCandidate = key, true
+}
+
+func (p *tinyLFUPolicy) Access(key uint64) {
+	p.sketch.add(key)
+	p.lru.Access(key)
+}
+
+func (p *tinyLFUPolicy) Remove(key uint64) {
+	p.lru.Remove(key)
+	if p.hasCandidate && p.candidate == key {
+		p.hasCandidate = false
+	}
+}
+
+func (p *tinyLFUPolicy) Evict() (uint64, bool) {
+	victim, ok := p.lru.victim()
+	if !ok {
+		return 0, false
+	}
+	if p.hasCandidate && victim != p.candidate {
+		p.hasCandidate = false
+		if p.sketch.estimate(p.candidate) <= p.sketch.estimate(victim) {
+			victim = p.candidate
+		}
+	}
+	p.Remove(victim)
+	return victim, true
+}
+
+const cmDepth = 4
+
+var cmSeeds = [cmDepth]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// cmSketch is a count-min sketch of counters saturating at 15 that are
+// halved periodically, so old popularity fades.
+type cmSketch struct {
+	rows      [cmDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCMSketch(capacity int) *cmSketch {
+	if capacity < 16 {
+		capacity = 16
+	}
+	width := 1
+	for width < capacity*4 {
+		width <<= 1
+	}
+	s := &cmSketch{mask: uint64(width - 1), resetAt: capacity * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *cmSketch) index(key uint64, i int) uint64 {
+	h := (key ^ cmSeeds[i]) * 0x9e3779b97f4a7c15
+	return (h >> 32) & s.mask
+}
+
+func (s *cmSketch) add(key uint64) {
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(key, i)]; *c < 15 {
+			*c++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *cmSketch) estimate(key uint64) uint8 {
+	result := uint8(255)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(key, i)]; c < result {
+			result = c
+		}
+	}
+	return result
+}
+
+func (s *cmSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
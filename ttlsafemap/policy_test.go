@@ -0,0 +1,131 @@
+package ttlsafemap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardMapLRU(t *testing.T) {
+	assert := assert.New(t)
+
+	var rec recorder[uint64]
+	capacity := func() (float64, float64) {
+		return testutil.ToFloat64(cacheEvictions.WithLabelValues("0", "capacity")),
+			testutil.ToFloat64(evictionsTotal.WithLabelValues("capacity"))
+	}
+	shardBefore, cacheBefore := capacity()
+	sm := NewShardMap(1, WithMaxEntries(3))
+	sm.OnEvicted(func(key uint64, _ any, reason EvictionReason) {
+		rec.record(key, reason)
+	})
+
+	sm.Set(1, 1, time.Minute)
+	sm.Set(2, 2, time.Minute)
+	sm.Set(3, 3, time.Minute)
+	sm.Get(1)
+	sm.Set(4, 4, time.Minute)
+
+	_, ok := sm.Get(2)
+	assert.False(ok, "the least recently used key is evicted")
+	for _, key := range []uint64{1, 3, 4} {
+		_, ok := sm.Get(key)
+		assert.True(ok, key)
+	}
+	assert.Equal(map[uint64]EvictionReason{2: EvictionCapacity}, rec.get())
+
+	// the eviction is only counted per shard
+	shardAfter, cacheAfter := capacity()
+	assert.Equal(shardBefore+1, shardAfter)
+	assert.Equal(cacheBefore, cacheAfter)
+}
+
+func TestShardMapLFU(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := NewShardMap(1, WithMaxEntries(3), WithPolicy(NewLFU))
+	sm.Set(1, 1, time.Minute)
+	sm.Set(2, 2, time.Minute)
+	sm.Set(3, 3, time.Minute)
+	for i := 0; i < 3; i++ {
+		sm.Get(1)
+		sm.Get(3)
+	}
+	sm.Get(2)
+	sm.Set(4, 4, time.Minute)
+
+	_, ok := sm.Get(2)
+	assert.False(ok, "the least frequently used key is evicted")
+	for _, key := range []uint64{1, 3, 4} {
+		_, ok := sm.Get(key)
+		assert.True(ok, key)
+	}
+}
+
+func TestShardMapTinyLFU(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := NewShardMap(1, WithMaxEntries(2), WithPolicy(NewTinyLFU))
+	sm.Set(1, 1, time.Minute)
+	sm.Set(2, 2, time.Minute)
+	for i := 0; i < 5; i++ {
+		sm.Get(1)
+		sm.Get(2)
+	}
+
+	// one-hit newcomers don't displace popular keys
+	for key := uint64(10); key < 20; key++ {
+		sm.Set(key, key, time.Minute)
+		_, ok := sm.Get(key)
+		assert.False(ok, key)
+	}
+	for _, key := range []uint64{1, 2} {
+		_, ok := sm.Get(key)
+		assert.True(ok, key)
+	}
+
+	// a key requested often enough is admitted
+	for i := 0; i < 20; i++ {
+		sm.Get(30)
+	}
+	sm.Set(30, 30, time.Minute)
+	_, ok := sm.Get(30)
+	assert.True(ok)
+}
+
+func TestShardMapMaxBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	sizer := func(value any) int64 { return int64(len(value.(string))) }
+	sm := NewShardMap(2, WithMaxBytes(20, sizer))
+	for key := uint64(0); key < 100; key++ {
+		sm.Set(key, "12345", time.Minute)
+	}
+	// replacing a value accounts for its new size
+	sm.Set(98, "1234567890", time.Minute)
+
+	var n int
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.RLock()
+		assert.LessOrEqual(shard.bytes, int64(10))
+		var bytes int64
+		for _, item := range shard.m {
+			bytes += sizer(item.Value)
+		}
+		assert.Equal(bytes, shard.bytes)
+		n += len(shard.m)
+		shard.RUnlock()
+	}
+	assert.Equal(3, n)
+
+	v, ok := sm.Get(98)
+	assert.True(ok)
+	assert.Equal("1234567890", v)
+	sm.Delete(98)
+	assert.Equal(int64(0), sm.getShard(98).bytes)
+
+	assert.Panics(func() { WithMaxBytes(20, nil) }, "a byte bound needs a sizer")
+}
@@ -9,35 +9,127 @@ import (
 	"github.com/rosenlo/toolkits/promutil"
 )
 
+// defaultPolicyCapacity sizes the policy of shards bounded by bytes only.
+const defaultPolicyCapacity = 1024
+
 var (
-	cacheTotal   *prometheus.GaugeVec
-	cacheExpired *prometheus.GaugeVec
-	cacheUsage   *prometheus.HistogramVec
+	cacheTotal     *prometheus.GaugeVec
+	cacheExpired   *prometheus.GaugeVec
+	cacheBytes     *prometheus.GaugeVec
+	cacheEvictions *prometheus.CounterVec
+	cacheUsage     *prometheus.HistogramVec
 )
 
 func init() {
 	cacheTotal, _ = promutil.NewGaugeVec("ttlsafemap_cache_total", "", []string{"shard_id"})
 	cacheExpired, _ = promutil.NewGaugeVec("ttlsafemap_cache_expired", "", []string{"shard_id"})
+	cacheBytes, _ = promutil.NewGaugeVec("ttlsafemap_cache_bytes", "Size of the entries of a shard bounded by bytes.", []string{"shard_id"})
+	cacheEvictions, _ = promutil.NewCounterVec("ttlsafemap_cache_evictions_total", "Entries removed from a shard by reason.", []string{"shard_id", "reason"})
 	cacheUsage, _ = promutil.NewHistogramVec("ttlsafemap_cache_usage", "", nil, []string{"shard_id", "method"})
 }
 
+type options struct {
+	maxEntries int
+	maxBytes   int64
+	sizer      func(value any) int64
+	policy     PolicyFactory
+}
+
+type Option func(*options)
+
+// WithMaxEntries bounds the number of entries, split evenly over the
+// shards. Every Get on a bounded shard records the access in the policy
+// and so takes the exclusive shard lock.
+func WithMaxEntries(n int) Option {
+	return func(o *options) {
+		o.maxEntries = n
+	}
+}
+
+// WithMaxBytes bounds the total size of the values as reported by sizer,
+// split evenly over the shards. It panics if n is positive and sizer is
+// nil. Like WithMaxEntries, every Get on a bounded shard takes the
+// exclusive shard lock.
+func WithMaxBytes(n int64, sizer func(value any) int64) Option {
+	if n > 0 && sizer == nil {
+		panic("ttlsafemap: WithMaxBytes requires a sizer")
+	}
+	return func(o *options) {
+		o.maxBytes = n
+		o.sizer = sizer
+	}
+}
+
+// WithPolicy selects the eviction policy of a bounded map, defaults to
+// NewLRU.
+func WithPolicy(policy PolicyFactory) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
 type Shard struct {
 	sync.RWMutex
-	id string
-	m  map[uint64]Item
+	id    string
+	m     map[uint64]Item
+	index *expiryIndex[uint64]
+	stop  chan struct{}
+
+	// policy is nil for unbounded shards
+	policy     Policy
+	maxEntries int
+	maxBytes   int64
+	sizer      func(value any) int64
+	bytes      int64
+	sizes      map[uint64]int64
+
+	onEvicted func(uint64, any, EvictionReason)
 }
 
 type ShardMap struct {
 	shardNum uint64
 	shards   []Shard
+
+	stopOnce sync.Once
+	stop     chan struct{}
 }
 
-func NewShardMap(shardNum int) *ShardMap {
-	sm := &ShardMap{shardNum: uint64(shardNum), shards: make([]Shard, shardNum)}
+// NewShardMap returns a map of shardNum shards, unbounded unless
+// WithMaxEntries or WithMaxBytes is given.
+func NewShardMap(shardNum int, opts ...Option) *ShardMap {
+	var o options
+	for _, fn := range opts {
+		fn(&o)
+	}
+	if o.policy == nil {
+		o.policy = NewLRU
+	}
+
+	sm := &ShardMap{
+		shardNum: uint64(shardNum),
+		shards:   make([]Shard, shardNum),
+		stop:     make(chan struct{}),
+	}
 	for i := 0; i < shardNum; i++ {
 		sm.shards[i] = Shard{
-			id: strconv.Itoa(i),
-			m:  make(map[uint64]Item),
+			id:    strconv.Itoa(i),
+			m:     make(map[uint64]Item),
+			index: newExpiryIndex[uint64](),
+			stop:  sm.stop,
+		}
+		shard := &sm.shards[i]
+		if o.maxEntries > 0 || o.maxBytes > 0 {
+			capacity := defaultPolicyCapacity
+			if o.maxEntries > 0 {
+				shard.maxEntries = (o.maxEntries + shardNum - 1) / shardNum
+				capacity = shard.maxEntries
+			}
+			if o.maxBytes > 0 {
+				shard.maxBytes = (o.maxBytes + int64(shardNum) - 1) / int64(shardNum)
+				shard.sizer = o.sizer
+				shard.sizes = make(map[uint64]int64)
+			}
+			shard.policy = o.policy(capacity)
 		}
 	}
 	return sm
@@ -47,6 +139,9 @@ func (sm *ShardMap) getShard(key uint64) *Shard {
 	return &sm.shards[key%sm.shardNum]
 }
 
+// Set stores value expiring after ttl. A ttl <= 0 stores an entry that is
+// already expired: it is never returned and the cleanup timer removes it.
+// Use Cache with NoExpiration for entries that must not expire.
 func (sm *ShardMap) Set(key uint64, value any, ttl time.Duration) {
 	shard := sm.getShard(key)
 	shard.Set(key, value, ttl)
@@ -68,67 +163,201 @@ func (sm *ShardMap) StartCleanupTimer(interval time.Duration) {
 	}
 }
 
+// OnEvicted sets fn to be called with every entry removed from the map
+// and the reason. fn is called without holding the shard lock. It must be
+// set before the map is used.
+func (sm *ShardMap) OnEvicted(fn func(key uint64, value any, reason EvictionReason)) {
+	for i := range sm.shards {
+		sm.shards[i].onEvicted = fn
+	}
+}
+
+// Stop stops the cleanup timers of all shards.
+func (sm *ShardMap) Stop() {
+	sm.stopOnce.Do(func() {
+		close(sm.stop)
+	})
+}
+
 func (c *Shard) Set(key uint64, value any, ttl time.Duration) {
 	start := time.Now()
 	item := Item{Value: value, Expiration: time.Now().Add(ttl).UnixNano()}
 
+	var size int64
+	if c.sizer != nil {
+		size = c.sizer(value)
+	}
+
 	c.Lock()
+	old, replaced := c.m[key]
 	c.m[key] = item
+	c.index.set(key, item.Expiration)
+	var evicted []eviction[uint64, any]
+	if replaced {
+		reason := EvictionReplaced
+		if start.UnixNano() > old.Expiration {
+			reason = EvictionExpired
+		}
+		evicted = append(evicted, eviction[uint64, any]{key, old.Value, reason})
+	}
+	if c.policy != nil {
+		if replaced {
+			c.policy.Access(key)
+		} else {
+			c.policy.Add(key)
+		}
+		if c.sizes != nil {
+			c.bytes += size - c.sizes[key]
+			c.sizes[key] = size
+		}
+		evicted = c.evictLocked(evicted)
+	}
 	c.Unlock()
 
 	cacheUsage.WithLabelValues(c.id, "set").Observe(time.Since(start).Seconds())
+
+	c.notify(evicted)
+}
+
+// evictLocked evicts entries chosen by the policy until the shard is
+// within its bounds.
+func (c *Shard) evictLocked(evicted []eviction[uint64, any]) []eviction[uint64, any] {
+	for (c.maxEntries > 0 && len(c.m) > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		key, ok := c.policy.Evict()
+		if !ok {
+			break
+		}
+		item, ok := c.m[key]
+		if !ok {
+			continue
+		}
+		c.removeLocked(key)
+		evicted = append(evicted, eviction[uint64, any]{key, item.Value, EvictionCapacity})
+	}
+	if c.sizes != nil {
+		cacheBytes.WithLabelValues(c.id).Set(float64(c.bytes))
+	}
+	return evicted
+}
+
+// removeLocked deletes key from the map and every index.
+func (c *Shard) removeLocked(key uint64) {
+	delete(c.m, key)
+	c.index.remove(key)
+	if c.policy != nil {
+		c.policy.Remove(key)
+	}
+	if c.sizes != nil {
+		c.bytes -= c.sizes[key]
+		delete(c.sizes, key)
+	}
+}
+
+func (c *Shard) notify(evicted []eviction[uint64, any]) {
+	for _, e := range evicted {
+		cacheEvictions.WithLabelValues(c.id, e.reason.String()).Inc()
+	}
+	notifyEvicted(c.onEvicted, evicted)
 }
 
 func (c *Shard) Get(key uint64) (any, bool) {
 	start := time.Now()
 
-	c.RLock()
-	item, ok := c.m[key]
-	c.RUnlock()
+	var (
+		item Item
+		ok   bool
+	)
+	if c.policy != nil {
+		// the policy records the access, misses included
+		c.Lock()
+		item, ok = c.m[key]
+		c.policy.Access(key)
+		c.Unlock()
+	} else {
+		c.RLock()
+		item, ok = c.m[key]
+		c.RUnlock()
+	}
 
 	cacheUsage.WithLabelValues(c.id, "get").Observe(time.Since(start).Seconds())
 
 	if !ok {
 		return nil, false
 	}
+	if time.Now().UnixNano() > item.Expiration {
+		c.deleteExpired(key, item.Expiration)
+		return nil, false
+	}
 
 	return item.Value, ok
 }
 
+// deleteExpired deletes key unless it was set again since it was read.
+func (c *Shard) deleteExpired(key uint64, expiration int64) {
+	c.Lock()
+	item, ok := c.m[key]
+	if !ok || item.Expiration != expiration {
+		c.Unlock()
+		return
+	}
+	c.removeLocked(key)
+	c.Unlock()
+
+	c.notify([]eviction[uint64, any]{{key, item.Value, EvictionExpired}})
+}
+
 func (c *Shard) Delete(key uint64) {
 	start := time.Now()
 
 	c.Lock()
-	delete(c.m, key)
+	item, ok := c.m[key]
+	if ok {
+		c.removeLocked(key)
+	}
 	c.Unlock()
 
 	cacheUsage.WithLabelValues(c.id, "delete").Observe(time.Since(start).Seconds())
+
+	if ok {
+		reason := EvictionDeleted
+		if start.UnixNano() > item.Expiration {
+			reason = EvictionExpired
+		}
+		c.notify([]eviction[uint64, any]{{key, item.Value, reason}})
+	}
 }
 
+// StartCleanupTimer removes expired entries every interval until the
+// ShardMap is stopped. Entries are visited in expiration order, so a sweep
+// only touches the expired ones.
 func (c *Shard) StartCleanupTimer(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
-			total := 0
-			expired := 0
-			deleteKeys := make([]uint64, 0)
-
-			c.RLock()
-			for key, item := range c.m {
-				total++
-				if time.Now().UnixNano() > item.Expiration {
-					expired++
-					deleteKeys = append(deleteKeys, key)
-				}
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
 			}
-			c.RUnlock()
 
-			for i := range deleteKeys {
-				c.Delete(deleteKeys[i])
+			c.Lock()
+			expired := c.index.popExpired(time.Now().UnixNano())
+			evicted := make([]eviction[uint64, any], 0, len(expired))
+			for _, key := range expired {
+				evicted = append(evicted, eviction[uint64, any]{key, c.m[key].Value, EvictionExpired})
+				c.removeLocked(key)
 			}
+			total := len(c.m)
+			if c.sizes != nil {
+				cacheBytes.WithLabelValues(c.id).Set(float64(c.bytes))
+			}
+			c.Unlock()
+
+			c.notify(evicted)
 
 			cacheTotal.WithLabelValues(c.id).Set(float64(total))
-			cacheExpired.WithLabelValues(c.id).Set(float64(expired))
+			cacheExpired.WithLabelValues(c.id).Set(float64(len(expired)))
 		}
 	}()
 }
@@ -0,0 +1,65 @@
+package ttlsafemap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardMapLazyExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := NewShardMap(4)
+	sm.Set(1, "short", time.Millisecond)
+	sm.Set(2, "long", time.Minute)
+
+	time.Sleep(5 * time.Millisecond)
+	_, ok := sm.Get(1)
+	assert.False(ok, "expired values are not returned before the sweep")
+	v, ok := sm.Get(2)
+	assert.True(ok)
+	assert.Equal("long", v)
+
+	shard := sm.getShard(1)
+	shard.RLock()
+	_, ok = shard.m[1]
+	shard.RUnlock()
+	assert.False(ok, "reading an expired key deletes it")
+
+	// a key set again after expiring is readable
+	sm.Set(1, "again", time.Minute)
+	v, ok = sm.Get(1)
+	assert.True(ok)
+	assert.Equal("again", v)
+}
+
+func TestShardMapCleanupTimer(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := NewShardMap(4)
+	for i := uint64(0); i < 1000; i++ {
+		sm.Set(i, i, time.Millisecond)
+	}
+	for i := uint64(1000); i < 1010; i++ {
+		sm.Set(i, i, time.Minute)
+	}
+	// a non-positive ttl is expired right away and swept too
+	sm.Set(2000, 2000, 0)
+	sm.Set(2001, 2001, -time.Second)
+	sm.Delete(1005)
+
+	sm.StartCleanupTimer(5 * time.Millisecond)
+	defer sm.Stop()
+
+	size := func() (n int) {
+		for i := range sm.shards {
+			sm.shards[i].RLock()
+			n += len(sm.shards[i].m)
+			assert.Equal(len(sm.shards[i].m), len(sm.shards[i].index.items))
+			sm.shards[i].RUnlock()
+		}
+		return n
+	}
+	assert.Eventually(func() bool { return size() == 9 }, time.Second, 5*time.Millisecond)
+}